@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+// Availability of each peripheral as derived from the metrics passing the formatter:
+// a peripheral is online once read and offline after too many consecutive failures.
+type availabilityTracker struct {
+	online map[string]bool
+}
+
+func newAvailabilityTracker() *availabilityTracker {
+	return &availabilityTracker{online: map[string]bool{}}
+}
+
+// returns the new availability if the metric changed it
+func (a *availabilityTracker) update(metric mifloraMetric, offlineAfter int) (string, bool) {
+	online, known := a.online[metric.getPeripheralId()]
+
+	switch metric := metric.(type) {
+	case mifloraDataMetric:
+		if known && online {
+			return "", false
+		}
+		a.online[metric.peripheralId] = true
+		return availabilityOnline, true
+	case mifloraErrorMetric:
+		if metric.failed == 0 || metric.consecutiveFailures < offlineAfter || (known && !online) {
+			return "", false
+		}
+		a.online[metric.peripheralId] = false
+		return availabilityOffline, true
+	}
+	return "", false
+}
+
+func formatAvailability(peripheralId string, availability string, topicPrefix string) mqttMessage {
+	return mqttMessage{
+		topic:    fmt.Sprintf("%s/%s", topicPrefix, peripheralId),
+		payload:  availability,
+		retained: true,
+	}
+}
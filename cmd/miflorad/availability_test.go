@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAvailabilityTracker(t *testing.T) {
+	tracker := newAvailabilityTracker()
+	failure := func(consecutiveFailures int) mifloraMetric {
+		return mifloraErrorMetric{peripheralId: "peri", failed: 1, consecutiveFailures: consecutiveFailures}
+	}
+
+	tables := []struct {
+		metric       mifloraMetric
+		availability string
+		changed      bool
+	}{
+		{mifloraDataMetric{peripheralId: "peri"}, availabilityOnline, true},
+		{mifloraDataMetric{peripheralId: "peri"}, "", false},
+		{failure(1), "", false},
+		{failure(2), "", false},
+		{failure(3), availabilityOffline, true},
+		{failure(4), "", false},
+		{mifloraErrorMetric{peripheralId: "peri", failed: 0}, "", false},
+		{mifloraDataMetric{peripheralId: "peri"}, availabilityOnline, true},
+		{mifloraSkippedMetric{peripheralId: "peri", skipped: 1}, "", false},
+		// unknown peripherals can be offline right away
+		{mifloraErrorMetric{peripheralId: "other", failed: 1, consecutiveFailures: 5}, availabilityOffline, true},
+	}
+
+	for _, table := range tables {
+		availability, changed := tracker.update(table.metric, 3)
+		assert.Equal(t, table.availability, availability)
+		assert.Equal(t, table.changed, changed)
+	}
+}
+
+func TestFormatMetricsAvailability(t *testing.T) {
+	send := make(chan mifloraMetric, 10)
+	publish := make(chan metricLine, 100)
+	messages := make(chan mqttMessage, 10)
+
+	send <- mifloraDataMetric{peripheralId: "peri"}
+	for i := 1; i <= 3; i++ {
+		send <- mifloraErrorMetric{peripheralId: "peri", failed: 1, consecutiveFailures: i}
+	}
+	close(send)
+	formatMetrics(graphiteFormat, send, publish, messages)
+	close(messages)
+
+	received := []mqttMessage{}
+	for message := range messages {
+		received = append(received, message)
+	}
+	assert.Equal(t, []mqttMessage{
+		{topic: "miflorad/availability/peri", payload: "online", retained: true},
+		{topic: "miflorad/availability/peri", payload: "offline", retained: true},
+	}, received)
+}
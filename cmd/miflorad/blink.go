@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	common "miflorad/common"
+
+	"github.com/pkg/errors"
+)
+
+// makes the LED of the peripheral flash for locating it physically
+func blinkPeripheral(backend common.MifloraBackend, peripheralID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *scanTimeout)
+	defer cancel()
+	conn, err := backend.Connect(ctx, peripheralID)
+	if err != nil {
+		return errors.Wrapf(err, "can't connect to %s", peripheralID)
+	}
+
+	err2 := common.RequestBlink(conn)
+
+	err3 := conn.Close()
+
+	if err2 != nil {
+		return errors.Wrap(err2, "can't request blink")
+	}
+
+	if err3 != nil {
+		return errors.Wrap(err3, "can't disconnect after blinking")
+	}
+
+	return nil
+}
+
+func runBlink(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] blink peripheral-id\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	backend, err := newBackend(*backendFlag, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open device, err: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := blinkPeripheral(backend, args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to blink peripheral %s, err: %s\n", args[0], err)
+		backend.Stop()
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Peripheral %s is blinking\n", args[0])
+
+	if err := backend.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to close device, err: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	sim "miflorad/common/sim"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlinkPeripheral(t *testing.T) {
+	simPeripheral := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	backend := sim.NewBackend(simPeripheral)
+
+	assert.NoError(t, blinkPeripheral(backend, "C4:7C:8D:66:D5:27"))
+	assert.Equal(t, 1, simPeripheral.Blinks)
+
+	*scanTimeout = 10 * time.Millisecond
+	defer func() { *scanTimeout = 10 * time.Second }()
+
+	assert.Error(t, blinkPeripheral(backend, "C4:7C:8D:00:00:00"))
+}
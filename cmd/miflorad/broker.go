@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// counts broker connection events since the start
+var (
+	brokerConnectionsLost atomic.Int64
+	brokerReconnects      atomic.Int64
+)
+
+type mqttLogger struct {
+	level string
+}
+
+func (logger mqttLogger) Println(a ...interface{}) {
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("mqtt %s:", logger.level), a)
+}
+
+func (logger mqttLogger) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "mqtt %s: "+format, logger.level, a)
+}
+
+// the broker URL given or else built from host, port and TLS usage
+func brokerURL() (string, error) {
+	if *brokerURLFlag != "" {
+		u, err := url.Parse(*brokerURLFlag)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid broker URL")
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+		default:
+			return "", errors.Errorf("Unsupported broker URL scheme %s", u.Scheme)
+		}
+		return *brokerURLFlag, nil
+	}
+
+	scheme, port := "tcp", 1883
+	if *brokerUseTLS {
+		scheme, port = "ssl", 8883
+	}
+	if *brokerPort != 0 {
+		port = *brokerPort
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(*brokerHost, strconv.Itoa(port))), nil
+}
+
+func getBrokerQoS() (byte, error) {
+	if *brokerQoS < 0 || *brokerQoS > 2 {
+		return 0, errors.Errorf("Invalid MQTT quality of service %d", *brokerQoS)
+	}
+	return byte(*brokerQoS), nil
+}
+
+// with announce the availability of miflorad is published on connect and registered as Last Will,
+// with the homie publish format the Homie device state is registered as Last Will instead
+func getMQTTOptions(announce bool) (*mqtt.ClientOptions, error) {
+	serverURL, err := brokerURL()
+	if err != nil {
+		return nil, err
+	}
+	qos, err := getBrokerQoS()
+	if err != nil {
+		return nil, err
+	}
+	availabilityTopic := *availabilityTopic
+	inventoryTopic := *inventoryTopic
+	announceHomie := announce && homie != nil
+	subscribeInventory := announce && inventoryTopic != ""
+	announce = announce && availabilityTopic != ""
+
+	// only used for ssl, tls, mqtts and wss URLs
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(serverURL).
+		SetTLSConfig(tlsConfig).
+		SetClientID(*brokerClientID).
+		SetUsername(*brokerUser).
+		SetPassword(*brokerPassword).
+		SetKeepAlive(*brokerKeepAlive).
+		SetCleanSession(*brokerCleanSession).
+		SetConnectRetry(*brokerConnectRetry).
+		SetConnectRetryInterval(*brokerRetryInterval).
+		SetAutoReconnect(*brokerAutoReconnect).
+		SetMaxReconnectInterval(*brokerMaxReconnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			lost := brokerConnectionsLost.Add(1)
+			fmt.Fprintf(os.Stderr, "Lost connection to MQTT broker (%d times so far), err: %s\n", lost, err)
+		}).
+		SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+			fmt.Fprintf(os.Stderr, "Reconnecting to MQTT broker %s...\n", serverURL)
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// the first connection is no reconnect
+			if brokerConnectionsLost.Load() > brokerReconnects.Load() {
+				reconnects := brokerReconnects.Add(1)
+				fmt.Fprintf(os.Stderr, "Reconnected to MQTT broker %s (%d times so far)\n", serverURL, reconnects)
+			}
+			// replaces the Last Will published by the broker after losing the connection,
+			// waiting for the token here would block the client
+			if announce {
+				client.Publish(availabilityTopic, qos, true, availabilityOnline)
+			}
+			if announceHomie {
+				client.Publish(homie.stateTopic(), qos, true, homie.connectState())
+			}
+			// the retained inventory records of an earlier run tell when peripherals were first seen
+			if subscribeInventory {
+				client.Subscribe(inventoryTopic+"/+", qos, func(_ mqtt.Client, message mqtt.Message) {
+					if message.Retained() {
+						rememberFirstSeen(message.Payload())
+					}
+				})
+			}
+		})
+
+	if announceHomie {
+		options.SetWill(homie.stateTopic(), homieLost, qos, true)
+	} else if announce {
+		options.SetWill(availabilityTopic, availabilityOffline, qos, true)
+	}
+
+	return options, nil
+}
+
+func connectMQTT(announce bool) (mqtt.Client, error) {
+	mqtt.WARN = mqttLogger{level: "warning"}
+	mqtt.ERROR = mqttLogger{level: "error"}
+	mqtt.CRITICAL = mqttLogger{level: "critical"}
+
+	options, err := getMQTTOptions(announce)
+	if err != nil {
+		return nil, err
+	}
+	serverURL := options.Servers[0].Redacted()
+
+	mqttClient := mqtt.NewClient(options)
+
+	token := mqttClient.Connect()
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		// with connect retry the client keeps trying in the background
+		fmt.Fprintf(os.Stderr, "Still connecting to MQTT broker %s...\n", serverURL)
+		return mqttClient, nil
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	fmt.Fprintf(os.Stderr, "Connected to MQTT broker %s\n", serverURL)
+
+	return mqttClient, nil
+}
+
+// the MQTT client and publish settings may be replaced on reload while publishing
+type brokerConnection struct {
+	lock   sync.RWMutex
+	client mqtt.Client
+	topic  string
+	qos    byte
+	retain bool
+	// the client has been connected with, only accessed by the reloader
+	settings brokerSettings
+	announce bool
+	// connects a new client on reconnect, only changed by tests
+	connect func(announce bool) (mqtt.Client, error)
+}
+
+// with announce the availability of miflorad is published, see getMQTTOptions
+func newBrokerConnection(announce bool) (*brokerConnection, error) {
+	qos, err := getBrokerQoS()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := currentBrokerSettings()
+	client, err := connectMQTT(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &brokerConnection{
+		client:   client,
+		topic:    *brokerTopicPrefix,
+		qos:      qos,
+		retain:   *brokerRetain,
+		settings: settings,
+		announce: announce,
+		connect:  connectMQTT,
+	}, nil
+}
+
+func (c *brokerConnection) publish(topic string, retained bool, payload string) error {
+	c.lock.RLock()
+	client, qos := c.client, c.qos
+	c.lock.RUnlock()
+
+	// the client would buffer messages in memory while reconnecting
+	if !client.IsConnectionOpen() {
+		return errors.New("Not connected to MQTT broker")
+	}
+
+	// the line may not have been delivered, so it must not be taken off the queue
+	token := client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(1 * time.Second) {
+		return errors.New("Publishing to MQTT broker timed out")
+	}
+	return token.Error()
+}
+
+// publishes a formatted metric line to its own topic or else the metrics topic
+func (c *brokerConnection) publishLine(line metricLine) error {
+	c.lock.RLock()
+	topic, retain := c.topic, c.retain
+	c.lock.RUnlock()
+
+	if line.topic != "" {
+		topic = line.topic
+	}
+	return c.publish(topic, retain || line.retained, line.line)
+}
+
+// takes over the current topic, QoS and retain settings
+func (c *brokerConnection) updateSettings() error {
+	qos, err := getBrokerQoS()
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.topic = *brokerTopicPrefix
+	c.qos = qos
+	c.retain = *brokerRetain
+	return nil
+}
+
+// connects using the current broker settings, the previous client is disconnected first
+// since with the same client ID the broker would take over its session and might send its
+// Last Will after the new client announced itself, it is connected again if connecting fails
+func (c *brokerConnection) reconnect() error {
+	settings := currentBrokerSettings()
+	// invalid settings (e.g. unreadable TLS files) keep the previous connection
+	if _, err := getMQTTOptions(c.announce); err != nil {
+		return errors.Wrap(err, "can't reconnect")
+	}
+
+	c.lock.RLock()
+	previous, previousSettings := c.client, c.settings
+	c.lock.RUnlock()
+
+	// a clean disconnect does not trigger the Last Will
+	if settings.availabilityTopic != previousSettings.availabilityTopic {
+		c.announceOffline(previous, previousSettings.availabilityTopic)
+	}
+	previous.Disconnect(1000)
+
+	client, err := c.connect(c.announce)
+	if err != nil {
+		previous.Connect()
+		return errors.Wrap(err, "can't reconnect")
+	}
+
+	c.lock.Lock()
+	c.client = client
+	c.settings = settings
+	c.lock.Unlock()
+	return nil
+}
+
+// publishes the offline state before disconnecting since the Last Will is only sent on connection loss
+func (c *brokerConnection) disconnect() {
+	c.lock.RLock()
+	client, qos, availabilityTopic := c.client, c.qos, c.settings.availabilityTopic
+	c.lock.RUnlock()
+
+	c.announceOffline(client, availabilityTopic)
+	if c.announce && homie != nil && client.IsConnectionOpen() {
+		token := client.Publish(homie.stateTopic(), qos, true, homieDisconnected)
+		if token.WaitTimeout(1*time.Second) && token.Error() != nil {
+			fmt.Fprintf(os.Stderr, "Failed to publish Homie state, err: %s\n", token.Error())
+		}
+	}
+	client.Disconnect(1000)
+}
+
+func (c *brokerConnection) announceOffline(client mqtt.Client, availabilityTopic string) {
+	if !c.announce || availabilityTopic == "" || !client.IsConnectionOpen() {
+		return
+	}
+
+	c.lock.RLock()
+	qos := c.qos
+	c.lock.RUnlock()
+
+	token := client.Publish(availabilityTopic, qos, true, availabilityOffline)
+	if token.WaitTimeout(1*time.Second) && token.Error() != nil {
+		fmt.Fprintf(os.Stderr, "Failed to publish offline state, err: %s\n", token.Error())
+	}
+}
+
+// settings that require a new broker connection when changed (including the TLS files contents)
+type brokerSettings struct {
+	host                 string
+	port                 int
+	url                  string
+	user                 string
+	password             string
+	useTLS               bool
+	clientID             string
+	keepAlive            time.Duration
+	cleanSession         bool
+	connectRetry         bool
+	connectRetryInterval time.Duration
+	autoReconnect        bool
+	maxReconnectInterval time.Duration
+	caFile               string
+	certFile             string
+	keyFile              string
+	serverName           string
+	tlsMinVersion        string
+	tlsFilesDigest       string
+	availabilityTopic    string
+}
+
+func currentBrokerSettings() brokerSettings {
+	return brokerSettings{
+		host:                 *brokerHost,
+		port:                 *brokerPort,
+		url:                  *brokerURLFlag,
+		user:                 *brokerUser,
+		password:             *brokerPassword,
+		useTLS:               *brokerUseTLS,
+		clientID:             *brokerClientID,
+		keepAlive:            *brokerKeepAlive,
+		cleanSession:         *brokerCleanSession,
+		connectRetry:         *brokerConnectRetry,
+		connectRetryInterval: *brokerRetryInterval,
+		autoReconnect:        *brokerAutoReconnect,
+		maxReconnectInterval: *brokerMaxReconnect,
+		caFile:               *brokerCAFile,
+		certFile:             *brokerCertFile,
+		keyFile:              *brokerKeyFile,
+		serverName:           *brokerServerName,
+		tlsMinVersion:        *brokerTLSMinVersion,
+		tlsFilesDigest:       tlsFilesDigest(),
+		availabilityTopic:    *availabilityTopic,
+	}
+}
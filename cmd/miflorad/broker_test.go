@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// only implements what brokerConnection uses
+type fakeMQTTClient struct {
+	mqtt.Client
+	connected     bool
+	stalled       bool
+	published     []fakeMQTTMessage
+	subscriptions map[string]mqtt.MessageHandler
+}
+
+type fakeMQTTMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  string
+}
+
+func (c *fakeMQTTClient) Connect() mqtt.Token {
+	c.connected = true
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeMQTTClient) Disconnect(quiesce uint) {
+	c.connected = false
+}
+
+func (c *fakeMQTTClient) IsConnectionOpen() bool {
+	return c.connected
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published = append(c.published, fakeMQTTMessage{topic, qos, retained, payload.(string)})
+	if c.stalled {
+		return &stalledMQTTToken{}
+	}
+	return &mqtt.DummyToken{}
+}
+
+// a token of a publish the broker never acknowledges
+type stalledMQTTToken struct {
+	mqtt.DummyToken
+}
+
+func (t *stalledMQTTToken) WaitTimeout(time.Duration) bool {
+	return false
+}
+
+func (c *fakeMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	if c.subscriptions == nil {
+		c.subscriptions = map[string]mqtt.MessageHandler{}
+	}
+	c.subscriptions[topic] = callback
+	return &mqtt.DummyToken{}
+}
+
+// only implements what the message handlers use
+type fakeMQTTReceived struct {
+	mqtt.Message
+	retained bool
+	payload  string
+}
+
+func (m fakeMQTTReceived) Retained() bool {
+	return m.retained
+}
+
+func (m fakeMQTTReceived) Payload() []byte {
+	return []byte(m.payload)
+}
+
+func TestBrokerURL(t *testing.T) {
+	defer applyConfig(&config{}, map[string]bool{})
+
+	tables := []struct {
+		flags    map[string]string
+		expected string
+	}{
+		{map[string]string{}, "ssl://localhost:8883"},
+		{map[string]string{"brokerusetls": "false"}, "tcp://localhost:1883"},
+		{map[string]string{"brokerhost": "mqtt.example.com", "brokerport": "8884"}, "ssl://mqtt.example.com:8884"},
+		{map[string]string{"brokerhost": "::1", "brokerusetls": "false"}, "tcp://[::1]:1883"},
+		{map[string]string{"brokerurl": "wss://mqtt.example.com/mqtt", "brokerport": "8884"}, "wss://mqtt.example.com/mqtt"},
+	}
+
+	for _, table := range tables {
+		applyConfig(&config{}, map[string]bool{})
+		for name, value := range table.flags {
+			assert.NoError(t, flag.Set(name, value))
+		}
+		url, err := brokerURL()
+		assert.NoError(t, err)
+		assert.Equal(t, table.expected, url)
+	}
+
+	flag.Set("brokerurl", "http://mqtt.example.com")
+	_, err := brokerURL()
+	assert.Error(t, err)
+}
+
+func TestGetMQTTOptions(t *testing.T) {
+	defer applyConfig(&config{}, map[string]bool{})
+
+	cfg := &config{}
+	cfg.Broker.ClientID = "miflorad-office"
+	cfg.Broker.KeepAlive = 1 * time.Minute
+	cleanSession := false
+	cfg.Broker.CleanSession = &cleanSession
+	connectRetry := true
+	cfg.Broker.ConnectRetry = &connectRetry
+	applyConfig(cfg, map[string]bool{})
+
+	options, err := getMQTTOptions(true)
+	assert.NoError(t, err)
+	assert.Equal(t, "ssl://localhost:8883", options.Servers[0].String())
+	assert.Equal(t, "miflorad-office", options.ClientID)
+	assert.Equal(t, int64(60), options.KeepAlive)
+	assert.False(t, options.CleanSession)
+	assert.True(t, options.ConnectRetry)
+	assert.True(t, options.AutoReconnect)
+	assert.Equal(t, 10*time.Minute, options.MaxReconnectInterval)
+	assert.True(t, options.WillEnabled)
+	assert.Equal(t, "miflorad/availability", options.WillTopic)
+	assert.Equal(t, []byte("offline"), options.WillPayload)
+	assert.True(t, options.WillRetained)
+
+	// live mode does not announce its availability
+	options, err = getMQTTOptions(false)
+	assert.NoError(t, err)
+	assert.False(t, options.WillEnabled)
+
+	// the Homie device state takes precedence
+	defer func() { homie = nil }()
+	homie = newHomieDevice("homie", "gw")
+	options, err = getMQTTOptions(true)
+	assert.NoError(t, err)
+	assert.True(t, options.WillEnabled)
+	assert.Equal(t, "homie/gw/$state", options.WillTopic)
+	assert.Equal(t, []byte("lost"), options.WillPayload)
+	assert.True(t, options.WillRetained)
+}
+
+func TestMQTTOptionsInventorySubscription(t *testing.T) {
+	defer func() { retainedFirstSeen = map[string]time.Time{} }()
+
+	options, err := getMQTTOptions(true)
+	assert.NoError(t, err)
+	client := &fakeMQTTClient{connected: true}
+	options.OnConnect(client)
+
+	handler := client.subscriptions["miflorad/inventory/+"]
+	assert.NotNil(t, handler)
+	// only retained records are of an earlier run
+	handler(client, fakeMQTTReceived{retained: false, payload: `{"address":"C4:7C:8D:66:D5:27","first_seen":"2020-04-02T10:00:00Z"}`})
+	assert.Empty(t, retainedFirstSeen)
+	handler(client, fakeMQTTReceived{retained: true, payload: `{"address":"C4:7C:8D:66:D5:27","first_seen":"2020-04-01T10:00:00Z"}`})
+	assert.Equal(t, map[string]time.Time{"c47c8d66d527": time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)}, retainedFirstSeen)
+
+	// live mode publishes no inventory
+	options, err = getMQTTOptions(false)
+	assert.NoError(t, err)
+	client = &fakeMQTTClient{connected: true}
+	options.OnConnect(client)
+	assert.Empty(t, client.subscriptions)
+}
+
+func TestBrokerConnectionDisconnect(t *testing.T) {
+	client := &fakeMQTTClient{connected: true}
+	broker := &brokerConnection{client: client, qos: 1, announce: true, settings: currentBrokerSettings()}
+
+	broker.disconnect()
+	assert.Equal(t, []fakeMQTTMessage{{"miflorad/availability", 1, true, "offline"}}, client.published)
+	assert.False(t, client.connected)
+
+	defer func() { homie = nil }()
+	homie = newHomieDevice("homie", "gw")
+	client = &fakeMQTTClient{connected: true}
+	broker.client = client
+
+	broker.disconnect()
+	assert.Equal(t, []fakeMQTTMessage{
+		{"miflorad/availability", 1, true, "offline"},
+		{"homie/gw/$state", 1, true, "disconnected"},
+	}, client.published)
+}
+
+func TestBrokerConnectionReconnect(t *testing.T) {
+	defer applyConfig(&config{}, map[string]bool{})
+
+	previous := &fakeMQTTClient{connected: true}
+	next := &fakeMQTTClient{}
+	var connectErr error
+	broker := &brokerConnection{client: previous, qos: 1, announce: true, settings: currentBrokerSettings(),
+		connect: func(bool) (mqtt.Client, error) {
+			// both clients would compete for the same client ID
+			assert.False(t, previous.connected)
+			if connectErr != nil {
+				return nil, connectErr
+			}
+			next.connected = true
+			return next, nil
+		}}
+
+	// the previous client is connected again if connecting fails
+	connectErr = errors.New("connection refused")
+	assert.Error(t, broker.reconnect())
+	assert.Same(t, previous, broker.client)
+	assert.True(t, previous.connected)
+
+	// cleanly disconnected without announcing offline as the topic is unchanged
+	connectErr = nil
+	assert.NoError(t, broker.reconnect())
+	assert.Same(t, next, broker.client)
+	assert.False(t, previous.connected)
+	assert.Empty(t, previous.published)
+
+	// invalid settings keep the current connection
+	assert.NoError(t, flag.Set("brokertlsminversion", "1.4"))
+	assert.Error(t, broker.reconnect())
+	assert.Same(t, next, broker.client)
+	assert.True(t, next.connected)
+}
+
+func TestBrokerConnectionPublish(t *testing.T) {
+	defer applyConfig(&config{}, map[string]bool{})
+
+	client := &fakeMQTTClient{}
+	broker := &brokerConnection{client: client, topic: "sensors", qos: 1}
+
+	// not buffered while disconnected
+	assert.Error(t, broker.publishLine(metricLine{line: "foo 1 1500000000"}))
+	assert.Empty(t, client.published)
+
+	client.connected = true
+	assert.NoError(t, broker.publishLine(metricLine{line: "foo 1 1500000000"}))
+	assert.NoError(t, broker.publishLine(metricLine{line: "16", topic: "homie/gw/peri/moisture", retained: true}))
+
+	qos := 2
+	retain := true
+	cfg := &config{}
+	cfg.Broker.TopicPrefix = "plants"
+	cfg.Broker.QoS = &qos
+	cfg.Broker.Retain = &retain
+	applyConfig(cfg, map[string]bool{})
+	assert.NoError(t, broker.updateSettings())
+	assert.NoError(t, broker.publishLine(metricLine{line: "bar 2 1500000001"}))
+	assert.NoError(t, broker.publishLine(metricLine{line: "16", topic: "plants/peri/moisture"}))
+	assert.NoError(t, broker.publish("miflorad/inventory/peri", false, "{}"))
+
+	assert.Equal(t, []fakeMQTTMessage{
+		{"sensors", 1, false, "foo 1 1500000000"},
+		{"homie/gw/peri/moisture", 1, true, "16"},
+		{"plants", 2, true, "bar 2 1500000001"},
+		{"plants/peri/moisture", 2, true, "16"},
+		{"miflorad/inventory/peri", 2, false, "{}"},
+	}, client.published)
+
+	qos = 3
+	applyConfig(cfg, map[string]bool{})
+	assert.Error(t, broker.updateSettings())
+
+	// unacknowledged lines are retried from the queue
+	client.stalled = true
+	assert.Error(t, broker.publishLine(metricLine{line: "baz 3 1500000002"}))
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	common "miflorad/common"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// settings read from the YAML configuration file, flags given on the command line take precedence
+type config struct {
+	Broker struct {
+		Host                 string        `yaml:"host"`
+		Port                 int           `yaml:"port"`
+		URL                  string        `yaml:"url"`
+		User                 string        `yaml:"user"`
+		Password             string        `yaml:"password"`
+		UseTLS               *bool         `yaml:"usetls"`
+		CAFile               string        `yaml:"cafile"`
+		CertFile             string        `yaml:"certfile"`
+		KeyFile              string        `yaml:"keyfile"`
+		ServerName           string        `yaml:"servername"`
+		TLSMinVersion        string        `yaml:"tlsminversion"`
+		TopicPrefix          string        `yaml:"topicprefix"`
+		ClientID             string        `yaml:"clientid"`
+		QoS                  *int          `yaml:"qos"`
+		Retain               *bool         `yaml:"retain"`
+		KeepAlive            time.Duration `yaml:"keepalive"`
+		CleanSession         *bool         `yaml:"cleansession"`
+		ConnectRetry         *bool         `yaml:"connectretry"`
+		ConnectRetryInterval time.Duration `yaml:"connectretryinterval"`
+		AutoReconnect        *bool         `yaml:"autoreconnect"`
+		MaxReconnectInterval time.Duration `yaml:"maxreconnectinterval"`
+		AvailabilityTopic    string        `yaml:"availabilitytopic"`
+		HomeAssistantPrefix  string        `yaml:"homeassistantprefix"`
+	} `yaml:"broker"`
+	Format struct {
+		PublishFormat  string `yaml:"publishformat"`
+		GraphitePrefix string `yaml:"graphiteprefix"`
+		TopicTemplate  string `yaml:"topictemplate"`
+		HomieBaseTopic string `yaml:"homiebasetopic"`
+	} `yaml:"format"`
+	Influx struct {
+		URL           string        `yaml:"url"`
+		Database      string        `yaml:"database"`
+		User          string        `yaml:"user"`
+		Password      string        `yaml:"password"`
+		Org           string        `yaml:"org"`
+		Bucket        string        `yaml:"bucket"`
+		Token         string        `yaml:"token"`
+		Precision     string        `yaml:"precision"`
+		BatchSize     int           `yaml:"batchsize"`
+		FlushInterval time.Duration `yaml:"flushinterval"`
+		Gzip          *bool         `yaml:"gzip"`
+	} `yaml:"influx"`
+	Prometheus struct {
+		Listen    string        `yaml:"listen"`
+		Staleness time.Duration `yaml:"staleness"`
+	} `yaml:"prometheus"`
+	Interval    time.Duration `yaml:"interval"`
+	Jitter      time.Duration `yaml:"jitter"`
+	ReadRetries int           `yaml:"readretries"`
+	ScanTimeout time.Duration `yaml:"scantimeout"`
+	// consecutive failed reads after that a sensor is reported offline
+	OfflineAfter int            `yaml:"offlineafter"`
+	Sensors      []sensorConfig `yaml:"sensors"`
+}
+
+type sensorConfig struct {
+	ID    string `yaml:"id"` // as "C4:7C:8D:xx:xx:xx"
+	Name  string `yaml:"name"`
+	Room  string `yaml:"room"`
+	Plant string `yaml:"plant"`
+	// overrides of the global settings, zero means not overridden
+	Interval    time.Duration `yaml:"interval"`
+	ReadRetries int           `yaml:"readretries"`
+	ScanTimeout time.Duration `yaml:"scantimeout"`
+	BindKey     string        `yaml:"bindkey"`
+}
+
+// friendly identification of a peripheral used in metric names and tags
+type peripheralLabels struct {
+	name  string
+	room  string
+	plant string
+}
+
+func loadConfig(path string) (*config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open config file")
+	}
+	defer file.Close()
+
+	cfg := &config{}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, errors.Wrapf(err, "can't parse config file %s", path)
+	}
+
+	seen := map[string]bool{}
+	for _, sensor := range cfg.Sensors {
+		if sensor.ID == "" {
+			return nil, errors.Errorf("sensor without id in config file %s", path)
+		}
+		id := strings.ToLower(sensor.ID)
+		if seen[id] {
+			return nil, errors.Errorf("sensor %s configured twice in config file %s", sensor.ID, path)
+		}
+		seen[id] = true
+		if sensor.BindKey != "" {
+			if _, err := common.ParseMiBeaconBindKey(sensor.BindKey); err != nil {
+				return nil, errors.Wrapf(err, "invalid bind key for sensor %s", sensor.ID)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// names of all flags given on the command line, must be called before applyConfig
+func commandLineFlags() map[string]bool {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
+
+// sets all flags that have not been given on the command line from the config file,
+// flags missing in the config file are reset to their defaults (e.g. on reload)
+func applyConfig(cfg *config, given map[string]bool) {
+	setFlag := func(name string, value string, present bool) {
+		if given[name] {
+			return
+		}
+		if !present {
+			value = flag.Lookup(name).DefValue
+		}
+		flag.Set(name, value)
+	}
+
+	setFlag("brokerhost", cfg.Broker.Host, cfg.Broker.Host != "")
+	setFlag("brokeruser", cfg.Broker.User, cfg.Broker.User != "")
+	setFlag("brokerpassword", cfg.Broker.Password, cfg.Broker.Password != "")
+	setBoolFlag := func(name string, value *bool) {
+		if value != nil {
+			setFlag(name, strconv.FormatBool(*value), true)
+		} else {
+			setFlag(name, "", false)
+		}
+	}
+	setDurationFlag := func(name string, value time.Duration) {
+		setFlag(name, value.String(), value != 0)
+	}
+
+	setFlag("brokerport", strconv.Itoa(cfg.Broker.Port), cfg.Broker.Port != 0)
+	setFlag("brokerurl", cfg.Broker.URL, cfg.Broker.URL != "")
+	setBoolFlag("brokerusetls", cfg.Broker.UseTLS)
+	setFlag("brokercafile", cfg.Broker.CAFile, cfg.Broker.CAFile != "")
+	setFlag("brokercertfile", cfg.Broker.CertFile, cfg.Broker.CertFile != "")
+	setFlag("brokerkeyfile", cfg.Broker.KeyFile, cfg.Broker.KeyFile != "")
+	setFlag("brokerservername", cfg.Broker.ServerName, cfg.Broker.ServerName != "")
+	setFlag("brokertlsminversion", cfg.Broker.TLSMinVersion, cfg.Broker.TLSMinVersion != "")
+	setFlag("brokertopicprefix", cfg.Broker.TopicPrefix, cfg.Broker.TopicPrefix != "")
+	setFlag("brokerclientid", cfg.Broker.ClientID, cfg.Broker.ClientID != "")
+	if cfg.Broker.QoS != nil {
+		setFlag("brokerqos", strconv.Itoa(*cfg.Broker.QoS), true)
+	} else {
+		setFlag("brokerqos", "", false)
+	}
+	setBoolFlag("brokerretain", cfg.Broker.Retain)
+	setDurationFlag("brokerkeepalive", cfg.Broker.KeepAlive)
+	setBoolFlag("brokercleansession", cfg.Broker.CleanSession)
+	setBoolFlag("brokerconnectretry", cfg.Broker.ConnectRetry)
+	setDurationFlag("brokerconnectretryinterval", cfg.Broker.ConnectRetryInterval)
+	setBoolFlag("brokerautoreconnect", cfg.Broker.AutoReconnect)
+	setDurationFlag("brokermaxreconnectinterval", cfg.Broker.MaxReconnectInterval)
+	setFlag("brokeravailabilitytopic", cfg.Broker.AvailabilityTopic, cfg.Broker.AvailabilityTopic != "")
+	setFlag("homeassistantprefix", cfg.Broker.HomeAssistantPrefix, cfg.Broker.HomeAssistantPrefix != "")
+	setFlag("publishformat", cfg.Format.PublishFormat, cfg.Format.PublishFormat != "")
+	setFlag("graphiteprefix", cfg.Format.GraphitePrefix, cfg.Format.GraphitePrefix != "")
+	setFlag("brokertopictemplate", cfg.Format.TopicTemplate, cfg.Format.TopicTemplate != "")
+	setFlag("homiebasetopic", cfg.Format.HomieBaseTopic, cfg.Format.HomieBaseTopic != "")
+	setFlag("influxurl", cfg.Influx.URL, cfg.Influx.URL != "")
+	setFlag("influxdatabase", cfg.Influx.Database, cfg.Influx.Database != "")
+	setFlag("influxuser", cfg.Influx.User, cfg.Influx.User != "")
+	setFlag("influxpassword", cfg.Influx.Password, cfg.Influx.Password != "")
+	setFlag("influxorg", cfg.Influx.Org, cfg.Influx.Org != "")
+	setFlag("influxbucket", cfg.Influx.Bucket, cfg.Influx.Bucket != "")
+	setFlag("influxtoken", cfg.Influx.Token, cfg.Influx.Token != "")
+	setFlag("influxprecision", cfg.Influx.Precision, cfg.Influx.Precision != "")
+	setFlag("influxbatchsize", strconv.Itoa(cfg.Influx.BatchSize), cfg.Influx.BatchSize != 0)
+	setDurationFlag("influxflushinterval", cfg.Influx.FlushInterval)
+	setBoolFlag("influxgzip", cfg.Influx.Gzip)
+	setFlag("prometheuslisten", cfg.Prometheus.Listen, cfg.Prometheus.Listen != "")
+	setDurationFlag("prometheusstaleness", cfg.Prometheus.Staleness)
+	setFlag("interval", cfg.Interval.String(), cfg.Interval != 0)
+	setFlag("jitter", cfg.Jitter.String(), cfg.Jitter != 0)
+	setFlag("readretries", strconv.Itoa(cfg.ReadRetries), cfg.ReadRetries != 0)
+	setFlag("scantimeout", cfg.ScanTimeout.String(), cfg.ScanTimeout != 0)
+	setFlag("offlineafter", strconv.Itoa(cfg.OfflineAfter), cfg.OfflineAfter != 0)
+}
+
+func (cfg *config) findSensor(peripheralID string) *sensorConfig {
+	for i := range cfg.Sensors {
+		if strings.EqualFold(cfg.Sensors[i].ID, peripheralID) {
+			return &cfg.Sensors[i]
+		}
+	}
+	return nil
+}
+
+// creates peripherals for all configured sensors followed by the
+// ones given on the command line that are not configured
+func newPeripherals(cfg *config, peripheralIDs []string, bindKeys map[string][]byte) []*peripheral {
+	peripherals := []*peripheral{}
+	add := func(sensor sensorConfig) {
+		bindKey := bindKeys[strings.ToLower(sensor.ID)]
+		if bindKey == nil && sensor.BindKey != "" {
+			// already validated when loading the config
+			bindKey, _ = common.ParseMiBeaconBindKey(sensor.BindKey)
+		}
+		peripherals = append(peripherals, &peripheral{
+			id:                sensor.ID,
+			lastMetaDataFetch: time.Unix(0, 0), // force immediate 1st request
+			bindKey:           bindKey,
+			labels:            peripheralLabels{name: sensor.Name, room: sensor.Room, plant: sensor.Plant},
+			interval:          sensor.Interval,
+			readRetries:       sensor.ReadRetries,
+			scanTimeout:       sensor.ScanTimeout,
+		})
+	}
+
+	for _, sensor := range cfg.Sensors {
+		add(sensor)
+	}
+	for _, peripheralID := range peripheralIDs {
+		if cfg.findSensor(peripheralID) == nil {
+			add(sensorConfig{ID: peripheralID})
+		}
+	}
+
+	return peripherals
+}
+
+func (p *peripheral) getInterval() time.Duration {
+	if p.interval != 0 {
+		return p.interval
+	}
+	return *interval
+}
+
+func (p *peripheral) getReadRetries() int {
+	if p.readRetries != 0 {
+		return p.readRetries
+	}
+	return *readRetries
+}
+
+func (p *peripheral) getScanTimeout() time.Duration {
+	if p.scanTimeout != 0 {
+		return p.scanTimeout
+	}
+	return *scanTimeout
+}
+
+var invalidGraphiteChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// the friendly name (if configured) usable as Graphite path component, else the peripheral ID
+func (l peripheralLabels) graphiteID(peripheralId string) string {
+	if l.name == "" {
+		return peripheralId
+	}
+	return invalidGraphiteChars.ReplaceAllString(l.name, "_")
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// additional Influx tags (sorted by key) for all configured labels e.g. ",name=ficus,room=office"
+func (l peripheralLabels) influxTags() string {
+	var b strings.Builder
+	for _, tag := range []struct{ key, value string }{{"name", l.name}, {"plant", l.plant}, {"room", l.room}} {
+		if tag.value != "" {
+			b.WriteString("," + tag.key + "=" + influxTagEscaper.Replace(tag.value))
+		}
+	}
+	return b.String()
+}
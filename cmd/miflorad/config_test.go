@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig("miflorad.example.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "mqtt.example.com", cfg.Broker.Host)
+	assert.Equal(t, true, *cfg.Broker.UseTLS)
+	assert.Equal(t, "homeassistant", cfg.Broker.HomeAssistantPrefix)
+	assert.Equal(t, "graphite", cfg.Format.PublishFormat)
+	assert.Equal(t, "{prefix}/{name}/{metric}", cfg.Format.TopicTemplate)
+	assert.Equal(t, 1*time.Minute, cfg.Interval)
+	assert.Equal(t, 10*time.Second, cfg.Jitter)
+	assert.Equal(t, "plants", cfg.Influx.Bucket)
+	assert.Equal(t, true, *cfg.Influx.Gzip)
+	assert.Equal(t, ":9521", cfg.Prometheus.Listen)
+	assert.Equal(t, 10*time.Minute, cfg.Prometheus.Staleness)
+	assert.Len(t, cfg.Sensors, 2)
+	assert.Equal(t, sensorConfig{
+		ID:          "C4:7C:8D:66:D5:28",
+		Name:        "cactus-kitchen",
+		Room:        "kitchen",
+		Plant:       "Echinocactus grusonii",
+		Interval:    10 * time.Minute,
+		ReadRetries: 3,
+		ScanTimeout: 20 * time.Second,
+		BindKey:     "b853075158487ca39a5b5ea9d5b8ef4c",
+	}, cfg.Sensors[1])
+	assert.Equal(t, &cfg.Sensors[0], cfg.findSensor("c4:7c:8d:66:d5:27"))
+	assert.Nil(t, cfg.findSensor("C4:7C:8D:00:00:00"))
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tables := []string{
+		"unknown: 1\n",
+		"interval: soon\n",
+		"sensors:\n  - name: no-id\n",
+		"sensors:\n  - id: C4:7C:8D:66:D5:27\n  - id: c4:7c:8d:66:d5:27\n",
+		"sensors:\n  - id: C4:7C:8D:66:D5:27\n    bindkey: 0011\n",
+	}
+
+	for _, table := range tables {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte(table), 0644))
+		_, err := loadConfig(path)
+		assert.Error(t, err, table)
+	}
+
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestApplyConfig(t *testing.T) {
+	defer func() {
+		flag.Set("brokerhost", "localhost")
+		flag.Set("brokerusetls", "true")
+		flag.Set("interval", "25s")
+		flag.Set("readretries", "2")
+	}()
+
+	// flags given on the command line are kept
+	flag.Set("readretries", "5")
+
+	given := map[string]bool{"readretries": true}
+
+	cfg := &config{Interval: 1 * time.Minute, ReadRetries: 3}
+	cfg.Broker.Host = "mqtt.example.com"
+	useTLS := false
+	cfg.Broker.UseTLS = &useTLS
+	applyConfig(cfg, given)
+
+	assert.Equal(t, "mqtt.example.com", *brokerHost)
+	assert.Equal(t, false, *brokerUseTLS)
+	assert.Equal(t, 1*time.Minute, *interval)
+	assert.Equal(t, 5, *readRetries)
+	assert.Equal(t, "", *brokerUser)
+
+	// settings removed from the config file are reset on reload
+	applyConfig(&config{}, given)
+
+	assert.Equal(t, "localhost", *brokerHost)
+	assert.Equal(t, true, *brokerUseTLS)
+	assert.Equal(t, 25*time.Second, *interval)
+	assert.Equal(t, 5, *readRetries)
+}
+
+func TestNewPeripherals(t *testing.T) {
+	cfg, err := loadConfig("miflorad.example.yaml")
+	assert.NoError(t, err)
+
+	bindKeys := map[string][]byte{"c4:7c:8d:66:d5:27": {0x01}}
+	peripherals := newPeripherals(cfg, []string{"c4:7c:8d:66:d5:28", "C4:7C:8D:66:D5:29"}, bindKeys)
+
+	assert.Len(t, peripherals, 3)
+	assert.Equal(t, "C4:7C:8D:66:D5:27", peripherals[0].id)
+	assert.Equal(t, peripheralLabels{name: "ficus-reception", room: "reception", plant: "Ficus benjamina"}, peripherals[0].labels)
+	assert.Equal(t, []byte{0x01}, peripherals[0].bindKey)
+	assert.Equal(t, *interval, peripherals[0].getInterval())
+	assert.Equal(t, "C4:7C:8D:66:D5:28", peripherals[1].id)
+	assert.Len(t, peripherals[1].bindKey, 16)
+	assert.Equal(t, 10*time.Minute, peripherals[1].getInterval())
+	assert.Equal(t, 3, peripherals[1].getReadRetries())
+	assert.Equal(t, 20*time.Second, peripherals[1].getScanTimeout())
+	assert.Equal(t, "C4:7C:8D:66:D5:29", peripherals[2].id)
+	assert.Equal(t, peripheralLabels{}, peripherals[2].labels)
+	assert.Equal(t, *readRetries, peripherals[2].getReadRetries())
+}
+
+func TestPeripheralLabels(t *testing.T) {
+	assert.Equal(t, "peri", peripheralLabels{}.graphiteID("peri"))
+	assert.Equal(t, "ficus_reception_2", peripheralLabels{name: "ficus reception.2"}.graphiteID("peri"))
+
+	assert.Equal(t, "", peripheralLabels{}.influxTags())
+	assert.Equal(t, `,name=ficus\ reception,plant=Ficus\ benjamina,room=reception`,
+		peripheralLabels{name: "ficus reception", room: "reception", plant: "Ficus benjamina"}.influxTags())
+}
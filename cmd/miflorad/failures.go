@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	common "miflorad/common"
+
+	"github.com/pkg/errors"
+)
+
+// category of the cause of a failed read cycle
+type failureReason string
+
+const (
+	failureScanTimeout      failureReason = "scan_timeout"
+	failureConnect          failureReason = "connect_error"
+	failureProfileDiscovery failureReason = "profile_discovery"
+	failureParse            failureReason = "parse_error"
+	failurePublish          failureReason = "publish_error"
+)
+
+func classifyFailure(err error) failureReason {
+	var profileDiscoveryErr *common.ProfileDiscoveryError
+	var shortPayloadErr *common.ShortPayloadError
+	var invalidFirmwareVersionErr *common.InvalidFirmwareVersionError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return failureScanTimeout
+	case errors.As(err, &profileDiscoveryErr):
+		return failureProfileDiscovery
+	case errors.Is(err, common.ErrPlaceholderData),
+		errors.As(err, &shortPayloadErr),
+		errors.As(err, &invalidFirmwareVersionErr):
+		return failureParse
+	default:
+		// includes connections dropped while reading
+		return failureConnect
+	}
+}
+
+// counts failed publishes per peripheral ID until they are reported by the next read cycle
+var (
+	publishFailuresLock sync.Mutex
+	publishFailures     = map[string]int{}
+)
+
+func recordPublishFailure(peripheralId string) {
+	publishFailuresLock.Lock()
+	defer publishFailuresLock.Unlock()
+	publishFailures[peripheralId]++
+}
+
+func takePublishFailures(peripheralId string) int {
+	publishFailuresLock.Lock()
+	defer publishFailuresLock.Unlock()
+	failures := publishFailures[peripheralId]
+	delete(publishFailures, peripheralId)
+	return failures
+}
+
+func (p *peripheral) recordFailure(send chan mifloraMetric, reason failureReason) {
+	p.consecutiveFailures++
+	send <- mifloraErrorMetric{
+		peripheralId:        common.MifloraGetAlphaNumericID(p.id),
+		labels:              p.labels,
+		failed:              1,
+		reason:              reason,
+		consecutiveFailures: p.consecutiveFailures,
+		interval:            p.getInterval(),
+	}
+}
+
+// reports the recovery once so that the consecutive failures drop back to zero
+func (p *peripheral) recordSuccess(send chan mifloraMetric) {
+	if p.consecutiveFailures == 0 {
+		return
+	}
+	p.consecutiveFailures = 0
+	send <- mifloraErrorMetric{
+		peripheralId: common.MifloraGetAlphaNumericID(p.id),
+		labels:       p.labels,
+		failed:       0,
+		interval:     p.getInterval(),
+	}
+}
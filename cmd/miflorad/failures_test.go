@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	common "miflorad/common"
+	sim "miflorad/common/sim"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	tables := []struct {
+		err    error
+		reason failureReason
+	}{
+		{errors.Wrap(errors.Wrap(context.DeadlineExceeded, "can't discover"), "can't connect"), failureScanTimeout},
+		{errors.Wrap(&common.ProfileDiscoveryError{Err: errors.New("no service")}, "can't read data"), failureProfileDiscovery},
+		{errors.Wrap(common.ErrPlaceholderData, "can't read data"), failureParse},
+		{errors.Wrap(&common.ShortPayloadError{Payload: "sensor data", Expected: 10, Actual: 2}, "can't read data"), failureParse},
+		{&common.InvalidFirmwareVersionError{FirmwareVersion: []byte{0xff}}, failureParse},
+		{errors.New("Connection dropped by device"), failureConnect},
+	}
+
+	for _, table := range tables {
+		assert.Equal(t, table.reason, classifyFailure(table.err), table.err.Error())
+	}
+}
+
+func TestReadAllPeripheralsFailures(t *testing.T) {
+	simPeripheral := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	backend := sim.NewBackend(simPeripheral)
+	setTestPeripherals("C4:7C:8D:66:D5:27")
+	defer func() { allPeripherals = nil }()
+
+	ctx := context.Background()
+	send := make(chan mifloraMetric, 10)
+
+	simPeripheral.FailConnects = 2 * *readRetries
+	readAllPeripherals(ctx, backend, send)
+	readAllPeripherals(ctx, backend, send)
+
+	assert.Equal(t, []mifloraMetric{
+		mifloraErrorMetric{peripheralId: "c47c8d66d527", failed: 1, reason: failureConnect, consecutiveFailures: 1, interval: *interval},
+		mifloraErrorMetric{peripheralId: "c47c8d66d527", failed: 1, reason: failureConnect, consecutiveFailures: 2, interval: *interval},
+	}, receiveMetrics(send))
+
+	// placeholder instead of sensor data
+	simPeripheral.AlwaysPlaceholder = true
+	readAllPeripherals(ctx, backend, send)
+	assert.Equal(t, []mifloraMetric{
+		mifloraErrorMetric{peripheralId: "c47c8d66d527", failed: 1, reason: failureParse, consecutiveFailures: 3, interval: *interval},
+	}, receiveMetrics(send))
+
+	// recovery resets the counter
+	simPeripheral.AlwaysPlaceholder = false
+	readAllPeripherals(ctx, backend, send)
+	metrics := receiveMetrics(send)
+	assert.Len(t, metrics, 2)
+	assert.IsType(t, mifloraDataMetric{}, metrics[0])
+	assert.Equal(t, mifloraErrorMetric{peripheralId: "c47c8d66d527", failed: 0, interval: *interval}, metrics[1])
+
+	// metrics of the last cycle could not be published
+	recordPublishFailure("c47c8d66d527")
+	readAllPeripherals(ctx, backend, send)
+	metrics = receiveMetrics(send)
+	assert.Len(t, metrics, 3)
+	assert.Equal(t, mifloraErrorMetric{peripheralId: "c47c8d66d527", failed: 1, reason: failurePublish, consecutiveFailures: 1, interval: *interval}, metrics[0])
+	assert.Equal(t, 0, takePublishFailures("c47c8d66d527"))
+}
+
+func TestReadAllPeripheralsScanTimeout(t *testing.T) {
+	backend := sim.NewBackend()
+	setTestPeripherals("C4:7C:8D:66:D5:27")
+	defer func() { allPeripherals = nil }()
+	allPeripherals[0].scanTimeout = 10 * time.Millisecond
+	allPeripherals[0].readRetries = 1
+
+	ctx := context.Background()
+	send := make(chan mifloraMetric, 10)
+	readAllPeripherals(ctx, backend, send)
+
+	assert.Equal(t, []mifloraMetric{
+		mifloraErrorMetric{peripheralId: "c47c8d66d527", failed: 1, reason: failureScanTimeout, consecutiveFailures: 1, interval: *interval},
+	}, receiveMetrics(send))
+}
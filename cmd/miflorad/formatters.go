@@ -1,38 +1,80 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"os"
 	"strings"
 	"time"
+
+	common "miflorad/common"
 )
 
-func publishGraphite(metric mifloraMetric, publish chan string, metricsBase string) {
+// the firmware version as number, false if there is none (passive mode) or it can't be parsed
+func numericFirmwareVersion(metric mifloraDataMetric) (int, bool) {
+	if metric.metaData.FirmwareVersion == "" {
+		return 0, false
+	}
+	version, err := metric.metaData.NumericFirmwareVersion()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping firmware version of peripheral %s, err: %s\n", metric.peripheralId, err)
+		return 0, false
+	}
+	return version, true
+}
+
+func formatGraphite(metric mifloraMetric, metricsBase string) []string {
 	timestamp := time.Now().Unix()
-	prefix := fmt.Sprintf("%s.miflora.%s", metricsBase, metric.getPeripheralId())
+	prefix := fmt.Sprintf("%s.miflora.%s", metricsBase, metric.getLabels().graphiteID(metric.getPeripheralId()))
+	lines := []string{}
 
 	switch metric := metric.(type) {
 	case mifloraDataMetric:
-		publish <- fmt.Sprintf("%s.battery_level %d %d", prefix, metric.metaData.BatteryLevel, timestamp)
-		publish <- fmt.Sprintf("%s.firmware_version %d %d", prefix, metric.metaData.NumericFirmwareVersion(), timestamp)
-		publish <- fmt.Sprintf("%s.temperature %.1f %d", prefix, metric.sensorData.Temperature, timestamp)
-		publish <- fmt.Sprintf("%s.brightness %d %d", prefix, metric.sensorData.Brightness, timestamp)
-		publish <- fmt.Sprintf("%s.moisture %d %d", prefix, metric.sensorData.Moisture, timestamp)
-		publish <- fmt.Sprintf("%s.conductivity %d %d", prefix, metric.sensorData.Conductivity, timestamp)
-		publish <- fmt.Sprintf("%s.connect_time %.2f %d", prefix, metric.connectTime, timestamp)
-		publish <- fmt.Sprintf("%s.readout_time %.2f %d", prefix, metric.readoutTime, timestamp)
-		publish <- fmt.Sprintf("%s.rssi %d %d", prefix, metric.rssi, timestamp)
+		lines = append(lines, fmt.Sprintf("%s.battery_level %d %d", prefix, metric.metaData.BatteryLevel, timestamp))
+		if version, ok := numericFirmwareVersion(metric); ok {
+			lines = append(lines, fmt.Sprintf("%s.firmware_version %d %d", prefix, version, timestamp))
+		}
+		lines = append(lines, fmt.Sprintf("%s.temperature %.1f %d", prefix, metric.sensorData.Temperature, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.brightness %d %d", prefix, metric.sensorData.Brightness, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.moisture %d %d", prefix, metric.sensorData.Moisture, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.conductivity %d %d", prefix, metric.sensorData.Conductivity, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.connect_time %.2f %d", prefix, metric.connectTime, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.readout_time %.2f %d", prefix, metric.readoutTime, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.rssi %d %d", prefix, metric.rssi, timestamp))
+	case mifloraHistoryMetric:
+		timestamp := metric.timestamp.Unix()
+		lines = append(lines, fmt.Sprintf("%s.temperature %.1f %d", prefix, metric.sensorData.Temperature, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.brightness %d %d", prefix, metric.sensorData.Brightness, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.moisture %d %d", prefix, metric.sensorData.Moisture, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.conductivity %d %d", prefix, metric.sensorData.Conductivity, timestamp))
 	case mifloraErrorMetric:
-		publish <- fmt.Sprintf("%s.failed %d %d", prefix, metric.failed, timestamp)
+		lines = append(lines, fmt.Sprintf("%s.failed %d %d", prefix, metric.failed, timestamp))
+		lines = append(lines, fmt.Sprintf("%s.consecutive_failures %d %d", prefix, metric.consecutiveFailures, timestamp))
+		if metric.reason != "" {
+			lines = append(lines, fmt.Sprintf("%s.failures.%s 1 %d", prefix, metric.reason, timestamp))
+		}
+	case mifloraSkippedMetric:
+		lines = append(lines, fmt.Sprintf("%s.skipped_readings %d %d", prefix, metric.skipped, timestamp))
 	}
+	return lines
 }
 
-func publishInflux(metric mifloraMetric, publish chan string) {
+// a line protocol line with the timestamp in the given precision, history metrics keep theirs
+func formatInflux(metric mifloraMetric, now time.Time, precision time.Duration) string {
+	timestamp := now
 	var b strings.Builder
-	b.WriteString(fmt.Sprintf("miflora,id=%s ", metric.getPeripheralId()))
+	b.WriteString(fmt.Sprintf("miflora,id=%s%s", metric.getPeripheralId(), metric.getLabels().influxTags()))
+	if metric, ok := metric.(mifloraErrorMetric); ok && metric.reason != "" {
+		b.WriteString(fmt.Sprintf(",reason=%s", metric.reason))
+	}
+	b.WriteString(" ")
 	switch metric := metric.(type) {
 	case mifloraDataMetric:
 		b.WriteString(fmt.Sprintf("battery_level=%d,", metric.metaData.BatteryLevel))
-		b.WriteString(fmt.Sprintf("firmware_version=%d,", metric.metaData.NumericFirmwareVersion()))
+		if version, ok := numericFirmwareVersion(metric); ok {
+			b.WriteString(fmt.Sprintf("firmware_version=%d,", version))
+		}
 		b.WriteString(fmt.Sprintf("temperature=%.1f,", metric.sensorData.Temperature))
 		b.WriteString(fmt.Sprintf("brightness=%d,", metric.sensorData.Brightness))
 		b.WriteString(fmt.Sprintf("moisture=%d,", metric.sensorData.Moisture))
@@ -40,9 +82,173 @@ func publishInflux(metric mifloraMetric, publish chan string) {
 		b.WriteString(fmt.Sprintf("connect_time=%.2f,", metric.connectTime))
 		b.WriteString(fmt.Sprintf("readout_time=%.2f,", metric.readoutTime))
 		b.WriteString(fmt.Sprintf("rssi=%d", metric.rssi))
+	case mifloraHistoryMetric:
+		b.WriteString(fmt.Sprintf("temperature=%.1f,", metric.sensorData.Temperature))
+		b.WriteString(fmt.Sprintf("brightness=%d,", metric.sensorData.Brightness))
+		b.WriteString(fmt.Sprintf("moisture=%d,", metric.sensorData.Moisture))
+		b.WriteString(fmt.Sprintf("conductivity=%d", metric.sensorData.Conductivity))
+		timestamp = metric.timestamp
 	case mifloraErrorMetric:
-		b.WriteString(fmt.Sprintf("failed=%d", metric.failed))
+		b.WriteString(fmt.Sprintf("failed=%d,", metric.failed))
+		b.WriteString(fmt.Sprintf("consecutive_failures=%d", metric.consecutiveFailures))
+	case mifloraSkippedMetric:
+		b.WriteString(fmt.Sprintf("skipped_readings=%d", metric.skipped))
+	}
+	b.WriteString(fmt.Sprintf(" %d", timestamp.UnixNano()/int64(precision)))
+	return b.String()
+}
+
+// characters that would split or wildcard an MQTT topic level
+var topicLevelEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// expands the placeholders of the topic template for the given metric name
+func expandTopicTemplate(template string, prefix string, peripheralId string, labels peripheralLabels, name string) string {
+	friendlyName := labels.name
+	if friendlyName == "" {
+		friendlyName = peripheralId
+	}
+	topic := strings.NewReplacer(
+		"{prefix}", prefix,
+		"{sensor}", peripheralId,
+		"{name}", topicLevelEscaper.Replace(friendlyName),
+		"{room}", topicLevelEscaper.Replace(labels.room),
+		"{metric}", name,
+	).Replace(template)
+	// an empty prefix must not lead to an empty topic level
+	return strings.TrimPrefix(topic, "/")
+}
+
+// one message with a plain value per metric, history metrics are skipped as
+// the payload carries no timestamp and they would overwrite the current values
+func formatTopics(metric mifloraMetric, template string, prefix string) []metricLine {
+	values := []struct{ name, value string }{}
+	add := func(name string, format string, value interface{}) {
+		values = append(values, struct{ name, value string }{name, fmt.Sprintf(format, value)})
+	}
+
+	switch metric := metric.(type) {
+	case mifloraDataMetric:
+		add("battery_level", "%d", metric.metaData.BatteryLevel)
+		if version, ok := numericFirmwareVersion(metric); ok {
+			add("firmware_version", "%d", version)
+		}
+		add("temperature", "%.1f", metric.sensorData.Temperature)
+		add("brightness", "%d", metric.sensorData.Brightness)
+		add("moisture", "%d", metric.sensorData.Moisture)
+		add("conductivity", "%d", metric.sensorData.Conductivity)
+		add("connect_time", "%.2f", metric.connectTime)
+		add("readout_time", "%.2f", metric.readoutTime)
+		add("rssi", "%d", metric.rssi)
+	case mifloraErrorMetric:
+		add("failed", "%d", metric.failed)
+		add("consecutive_failures", "%d", metric.consecutiveFailures)
+	case mifloraSkippedMetric:
+		add("skipped_readings", "%d", metric.skipped)
+	}
+
+	lines := make([]metricLine, len(values))
+	for i, value := range values {
+		lines[i] = metricLine{
+			peripheralId: metric.getPeripheralId(),
+			line:         value.value,
+			topic:        expandTopicTemplate(template, prefix, metric.getPeripheralId(), metric.getLabels(), value.name),
+		}
 	}
-	b.WriteString(fmt.Sprintf(" %d", time.Now().UnixNano()))
-	publish <- b.String()
+	return lines
+}
+
+// version of the documents of the json format, increased on incompatible changes only
+const jsonSchemaVersion = 1
+
+type jsonSensor struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Room  string `json:"room,omitempty"`
+	Plant string `json:"plant,omitempty"`
+}
+
+type jsonValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+type jsonError struct {
+	Failed              int    `json:"failed"`
+	Reason              string `json:"reason,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+}
+
+// A self-describing document per metric, see the README for the schema. The type is one
+// of reading, history (with the timestamp of the on-device entry), error or skipped.
+type jsonDocument struct {
+	Version         int                  `json:"version"`
+	Type            string               `json:"type"`
+	Sensor          jsonSensor           `json:"sensor"`
+	Timestamp       string               `json:"timestamp"`
+	TimestampEpoch  int64                `json:"timestamp_epoch"`
+	Values          map[string]jsonValue `json:"values,omitempty"`
+	Battery         *jsonValue           `json:"battery,omitempty"`
+	Firmware        string               `json:"firmware,omitempty"`
+	RSSI            *jsonValue           `json:"rssi,omitempty"`
+	Timings         map[string]jsonValue `json:"timings,omitempty"`
+	Error           *jsonError           `json:"error,omitempty"`
+	SkippedReadings int                  `json:"skipped_readings,omitempty"`
+}
+
+func jsonSensorValues(sensorData common.SensorDataResponse) map[string]jsonValue {
+	return map[string]jsonValue{
+		"temperature":  {sensorData.Temperature, "°C"},
+		"brightness":   {float64(sensorData.Brightness), "lx"},
+		"moisture":     {float64(sensorData.Moisture), "%"},
+		"conductivity": {float64(sensorData.Conductivity), "µS/cm"},
+	}
+}
+
+// one document per metric, timestamped now unless it is a history metric
+func formatJSON(metric mifloraMetric, now time.Time) string {
+	labels := metric.getLabels()
+	document := jsonDocument{
+		Version: jsonSchemaVersion,
+		Sensor: jsonSensor{
+			ID:    metric.getPeripheralId(),
+			Name:  labels.name,
+			Room:  labels.room,
+			Plant: labels.plant,
+		},
+	}
+	if document.Sensor.Name == "" {
+		document.Sensor.Name = metric.getPeripheralId()
+	}
+
+	switch metric := metric.(type) {
+	case mifloraDataMetric:
+		document.Type = "reading"
+		document.Values = jsonSensorValues(metric.sensorData)
+		document.Battery = &jsonValue{float64(metric.metaData.BatteryLevel), "%"}
+		document.Firmware = metric.metaData.FirmwareVersion
+		document.RSSI = &jsonValue{float64(metric.rssi), "dBm"}
+		document.Timings = map[string]jsonValue{
+			"connect_time": {math.Round(metric.connectTime*100) / 100, "s"},
+			"readout_time": {math.Round(metric.readoutTime*100) / 100, "s"},
+		}
+	case mifloraHistoryMetric:
+		document.Type = "history"
+		document.Values = jsonSensorValues(metric.sensorData)
+		now = metric.timestamp
+	case mifloraErrorMetric:
+		document.Type = "error"
+		document.Error = &jsonError{
+			Failed:              metric.failed,
+			Reason:              string(metric.reason),
+			ConsecutiveFailures: metric.consecutiveFailures,
+		}
+	case mifloraSkippedMetric:
+		document.Type = "skipped"
+		document.SkippedReadings = metric.skipped
+	}
+	document.Timestamp = now.UTC().Format(time.RFC3339)
+	document.TimestampEpoch = now.Unix()
+
+	payload, _ := json.Marshal(document)
+	return string(payload)
 }
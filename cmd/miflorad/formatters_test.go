@@ -5,17 +5,18 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	common "miflorad/common"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestPublishGraphite(t *testing.T) {
+func TestFormatGraphite(t *testing.T) {
 	tables := []struct {
 		metric mifloraMetric
 	}{
-		{mifloraErrorMetric{peripheralId: "peri", failed: 1}},
+		{mifloraErrorMetric{peripheralId: "peri", failed: 1, reason: failureScanTimeout, consecutiveFailures: 3}},
 		{mifloraDataMetric{
 			peripheralId: "peri",
 			metaData:     common.VersionBatteryResponse{BatteryLevel: 100, FirmwareVersion: "2.7.0"},
@@ -24,25 +25,34 @@ func TestPublishGraphite(t *testing.T) {
 			readoutTime:  0.23,
 			rssi:         -77,
 		}},
+		{mifloraHistoryMetric{
+			peripheralId: "peri",
+			timestamp:    time.Unix(1500000000, 0),
+			sensorData:   common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		}},
+		{mifloraSkippedMetric{peripheralId: "peri", skipped: 2}},
 	}
 
 	for _, table := range tables {
-		publish := make(chan string, 100)
-		publishGraphite(table.metric, publish, "foo.base")
-		close(publish)
+		lines := formatGraphite(table.metric, "foo.base")
 		switch table.metric.(type) {
 		case mifloraErrorMetric:
-			for line := range publish {
+			names := []string{}
+			for _, line := range lines {
 				parts := strings.Split(line, " ")
 				assert.Equal(t, 3, len(parts))
-				assert.Equal(t, "foo.base.miflora.peri.failed", parts[0])
-				assert.Equal(t, "1", parts[1])
+				names = append(names, parts[0]+" "+parts[1])
 				timestamp, err := strconv.ParseInt(parts[2], 10, 64)
 				assert.NoError(t, err)
 				assert.True(t, timestamp >= 0)
 			}
+			assert.Equal(t, []string{
+				"foo.base.miflora.peri.failed 1",
+				"foo.base.miflora.peri.consecutive_failures 3",
+				"foo.base.miflora.peri.failures.scan_timeout 1",
+			}, names)
 		case mifloraDataMetric:
-			for line := range publish {
+			for _, line := range lines {
 				parts := strings.Split(line, " ")
 				assert.Equal(t, 3, len(parts))
 				assert.Equal(t, 0, strings.Index(parts[0], "foo.base.miflora.peri"))
@@ -51,15 +61,27 @@ func TestPublishGraphite(t *testing.T) {
 				assert.NoError(t, err)
 				assert.True(t, timestamp >= 0)
 			}
+		case mifloraHistoryMetric:
+			assert.Len(t, lines, 4)
+			for _, line := range lines {
+				parts := strings.Split(line, " ")
+				assert.Equal(t, 3, len(parts))
+				assert.Equal(t, 0, strings.Index(parts[0], "foo.base.miflora.peri"))
+				assert.True(t, len(parts[1]) > 0)
+				assert.Equal(t, "1500000000", parts[2])
+			}
+		case mifloraSkippedMetric:
+			line := lines[0]
+			assert.True(t, strings.HasPrefix(line, "foo.base.miflora.peri.skipped_readings 2 "))
 		}
 	}
 }
 
-func TestPublishInflux(t *testing.T) {
+func TestFormatInflux(t *testing.T) {
 	tables := []struct {
 		metric mifloraMetric
 	}{
-		{mifloraErrorMetric{peripheralId: "peri", failed: 1}},
+		{mifloraErrorMetric{peripheralId: "peri", failed: 1, reason: failureScanTimeout, consecutiveFailures: 3}},
 		{mifloraDataMetric{
 			peripheralId: "peri",
 			metaData:     common.VersionBatteryResponse{BatteryLevel: 100, FirmwareVersion: "2.7.0"},
@@ -68,24 +90,28 @@ func TestPublishInflux(t *testing.T) {
 			readoutTime:  0.23,
 			rssi:         -77,
 		}},
+		{mifloraHistoryMetric{
+			peripheralId: "peri",
+			timestamp:    time.Unix(1500000000, 0),
+			sensorData:   common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		}},
+		{mifloraSkippedMetric{peripheralId: "peri", skipped: 2}},
 	}
 
 	for _, table := range tables {
-		publish := make(chan string, 100)
-		publishInflux(table.metric, publish)
-		close(publish)
+		lines := []string{formatInflux(table.metric, time.Now(), time.Nanosecond)}
 		switch table.metric.(type) {
 		case mifloraErrorMetric:
-			line := <-publish
+			line := lines[0]
 			parts := strings.Split(line, " ")
 			assert.Equal(t, 3, len(parts))
-			assert.Equal(t, "miflora,id=peri", parts[0])
-			assert.Equal(t, "failed=1", parts[1])
+			assert.Equal(t, "miflora,id=peri,reason=scan_timeout", parts[0])
+			assert.Equal(t, "failed=1,consecutive_failures=3", parts[1])
 			timestamp, err := strconv.ParseInt(parts[2], 10, 64)
 			assert.NoError(t, err)
 			assert.True(t, timestamp >= 0)
 		case mifloraDataMetric:
-			line := <-publish
+			line := lines[0]
 			parts := strings.Split(line, " ")
 			assert.Equal(t, 3, len(parts))
 			assert.Equal(t, "miflora,id=peri", parts[0])
@@ -93,6 +119,164 @@ func TestPublishInflux(t *testing.T) {
 			timestamp, err := strconv.ParseInt(parts[2], 10, 64)
 			assert.NoError(t, err)
 			assert.True(t, timestamp >= 0)
+		case mifloraHistoryMetric:
+			line := lines[0]
+			parts := strings.Split(line, " ")
+			assert.Equal(t, 3, len(parts))
+			assert.Equal(t, "miflora,id=peri", parts[0])
+			assert.Equal(t, "temperature=24.2,brightness=121,moisture=16,conductivity=101", parts[1])
+			assert.Equal(t, "1500000000000000000", parts[2])
+		case mifloraSkippedMetric:
+			line := lines[0]
+			assert.True(t, strings.HasPrefix(line, "miflora,id=peri skipped_readings=2 "))
 		}
 	}
 }
+
+func TestPublishWithLabels(t *testing.T) {
+	metric := mifloraErrorMetric{
+		peripheralId: "peri",
+		labels:       peripheralLabels{name: "ficus reception", room: "reception"},
+		failed:       1,
+	}
+
+	assert.True(t, strings.HasPrefix(formatGraphite(metric, "foo.base")[0], "foo.base.miflora.ficus_reception.failed 1 "))
+
+	assert.True(t, strings.HasPrefix(formatInflux(metric, time.Now(), time.Nanosecond), "miflora,id=peri,name=ficus\\ reception,room=reception failed=1,consecutive_failures=0 "))
+}
+
+func TestExpandTopicTemplate(t *testing.T) {
+	tables := []struct {
+		template string
+		prefix   string
+		labels   peripheralLabels
+		expected string
+	}{
+		{"{prefix}/{sensor}/{metric}", "sensors", peripheralLabels{}, "sensors/peri/moisture"},
+		{"{prefix}/{sensor}/{metric}", "", peripheralLabels{}, "peri/moisture"},
+		{"{prefix}/{name}/{metric}", "sensors", peripheralLabels{}, "sensors/peri/moisture"},
+		{"{prefix}/{room}/{name}/{metric}", "sensors", peripheralLabels{name: "ficus #2", room: "office/1"}, "sensors/office_1/ficus _2/moisture"},
+	}
+
+	for _, table := range tables {
+		assert.Equal(t, table.expected, expandTopicTemplate(table.template, table.prefix, "peri", table.labels, "moisture"))
+	}
+}
+
+func TestFormatTopics(t *testing.T) {
+	lines := formatTopics(mifloraDataMetric{
+		peripheralId: "peri",
+		labels:       peripheralLabels{name: "ficus"},
+		metaData:     common.VersionBatteryResponse{BatteryLevel: 100, FirmwareVersion: "2.7.0"},
+		sensorData:   common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		connectTime:  3.42,
+		readoutTime:  0.23,
+		rssi:         -77,
+	}, "{prefix}/{name}/{metric}", "sensors")
+
+	assert.Len(t, lines, 9)
+	assert.Equal(t, metricLine{peripheralId: "peri", line: "100", topic: "sensors/ficus/battery_level"}, lines[0])
+	assert.Equal(t, metricLine{peripheralId: "peri", line: "24.2", topic: "sensors/ficus/temperature"}, lines[2])
+	assert.Equal(t, metricLine{peripheralId: "peri", line: "16", topic: "sensors/ficus/moisture"}, lines[4])
+	assert.Equal(t, metricLine{peripheralId: "peri", line: "-77", topic: "sensors/ficus/rssi"}, lines[8])
+
+	lines = formatTopics(mifloraErrorMetric{peripheralId: "peri", failed: 1, consecutiveFailures: 2}, "{sensor}/{metric}", "")
+	assert.Equal(t, []metricLine{
+		{peripheralId: "peri", line: "1", topic: "peri/failed"},
+		{peripheralId: "peri", line: "2", topic: "peri/consecutive_failures"},
+	}, lines)
+
+	assert.Empty(t, formatTopics(mifloraHistoryMetric{peripheralId: "peri"}, "{sensor}/{metric}", ""))
+}
+
+func TestSkipUnparsableFirmwareVersion(t *testing.T) {
+	metric := mifloraDataMetric{
+		peripheralId: "peri",
+		metaData:     common.VersionBatteryResponse{BatteryLevel: 100, FirmwareVersion: "1.x.5"},
+		sensorData:   common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+	}
+
+	lines := formatTopics(metric, "{sensor}/{metric}", "")
+	assert.Len(t, lines, 8)
+	for _, line := range lines {
+		assert.NotEqual(t, "peri/firmware_version", line.topic)
+	}
+
+	line := formatInflux(metric, time.Unix(1500000000, 0), time.Second)
+	assert.Equal(t, "miflora,id=peri battery_level=100,temperature=24.2,brightness=121,moisture=16,conductivity=101,"+
+		"connect_time=0.00,readout_time=0.00,rssi=0 1500000000", line)
+
+	metric.metaData.FirmwareVersion = ""
+	assert.Len(t, formatTopics(metric, "{sensor}/{metric}", ""), 8)
+}
+
+func TestFormatJSON(t *testing.T) {
+	now := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+
+	document := formatJSON(mifloraDataMetric{
+		peripheralId: "peri",
+		labels:       peripheralLabels{name: "ficus", room: "office"},
+		metaData:     common.VersionBatteryResponse{BatteryLevel: 100, FirmwareVersion: "2.7.0"},
+		sensorData:   common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		connectTime:  3.421,
+		readoutTime:  0.23,
+		rssi:         -77,
+	}, now)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"type": "reading",
+		"sensor": {"id": "peri", "name": "ficus", "room": "office"},
+		"timestamp": "2017-07-14T02:40:00Z",
+		"timestamp_epoch": 1500000000,
+		"values": {
+			"temperature": {"value": 24.2, "unit": "°C"},
+			"brightness": {"value": 121, "unit": "lx"},
+			"moisture": {"value": 16, "unit": "%"},
+			"conductivity": {"value": 101, "unit": "µS/cm"}
+		},
+		"battery": {"value": 100, "unit": "%"},
+		"firmware": "2.7.0",
+		"rssi": {"value": -77, "unit": "dBm"},
+		"timings": {
+			"connect_time": {"value": 3.42, "unit": "s"},
+			"readout_time": {"value": 0.23, "unit": "s"}
+		}
+	}`, document)
+	assert.NotContains(t, document, "\n")
+
+	document = formatJSON(mifloraHistoryMetric{
+		peripheralId: "peri",
+		timestamp:    time.Unix(1400000000, 0),
+		sensorData:   common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+	}, now)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"type": "history",
+		"sensor": {"id": "peri", "name": "peri"},
+		"timestamp": "2014-05-13T16:53:20Z",
+		"timestamp_epoch": 1400000000,
+		"values": {
+			"temperature": {"value": 24.2, "unit": "°C"},
+			"brightness": {"value": 121, "unit": "lx"},
+			"moisture": {"value": 16, "unit": "%"},
+			"conductivity": {"value": 101, "unit": "µS/cm"}
+		}
+	}`, document)
+
+	document = formatJSON(mifloraErrorMetric{peripheralId: "peri", failed: 1, reason: failureScanTimeout, consecutiveFailures: 3}, now)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"type": "error",
+		"sensor": {"id": "peri", "name": "peri"},
+		"timestamp": "2017-07-14T02:40:00Z",
+		"timestamp_epoch": 1500000000,
+		"error": {"failed": 1, "reason": "scan_timeout", "consecutive_failures": 3}
+	}`, document)
+
+	document = formatJSON(mifloraErrorMetric{peripheralId: "peri"}, now)
+	assert.Contains(t, document, `"error":{"failed":0,"consecutive_failures":0}`)
+
+	document = formatJSON(mifloraSkippedMetric{peripheralId: "peri", skipped: 2}, now)
+	assert.Contains(t, document, `"type":"skipped"`)
+	assert.Contains(t, document, `"skipped_readings":2`)
+}
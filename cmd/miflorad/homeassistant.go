@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// a Home Assistant sensor entity per metric, the firmware version is part of the device instead
+type homeAssistantSensor struct {
+	metric         string
+	name           string
+	deviceClass    string
+	unit           string
+	entityCategory string
+}
+
+var homeAssistantSensors = []homeAssistantSensor{
+	{"temperature", "Temperature", "temperature", "°C", ""},
+	{"moisture", "Moisture", "moisture", "%", ""},
+	{"brightness", "Illuminance", "illuminance", "lx", ""},
+	{"conductivity", "Conductivity", "conductivity", "µS/cm", ""},
+	{"battery_level", "Battery", "battery", "%", "diagnostic"},
+	{"rssi", "Signal strength", "signal_strength", "dBm", "diagnostic"},
+	{"connect_time", "Connect time", "duration", "s", "diagnostic"},
+	{"readout_time", "Readout time", "duration", "s", "diagnostic"},
+}
+
+type homeAssistantDevice struct {
+	Identifiers   []string   `json:"identifiers"`
+	Connections   [][]string `json:"connections,omitempty"`
+	Name          string     `json:"name"`
+	Manufacturer  string     `json:"manufacturer"`
+	Model         string     `json:"model"`
+	SWVersion     string     `json:"sw_version,omitempty"`
+	SuggestedArea string     `json:"suggested_area,omitempty"`
+}
+
+type homeAssistantAvailability struct {
+	Topic string `json:"topic"`
+}
+
+// see https://www.home-assistant.io/integrations/sensor.mqtt/
+type homeAssistantConfig struct {
+	Name              string                      `json:"name"`
+	UniqueID          string                      `json:"unique_id"`
+	StateTopic        string                      `json:"state_topic"`
+	ValueTemplate     string                      `json:"value_template"`
+	DeviceClass       string                      `json:"device_class,omitempty"`
+	UnitOfMeasurement string                      `json:"unit_of_measurement"`
+	StateClass        string                      `json:"state_class"`
+	EntityCategory    string                      `json:"entity_category,omitempty"`
+	Availability      []homeAssistantAvailability `json:"availability,omitempty"`
+	AvailabilityMode  string                      `json:"availability_mode,omitempty"`
+	Device            homeAssistantDevice         `json:"device"`
+}
+
+// keys match the metric names of the other formats
+type homeAssistantState struct {
+	Temperature  float64 `json:"temperature"`
+	Moisture     uint8   `json:"moisture"`
+	Brightness   uint32  `json:"brightness"`
+	Conductivity uint16  `json:"conductivity"`
+	BatteryLevel uint8   `json:"battery_level"`
+	RSSI         int     `json:"rssi"`
+	ConnectTime  float64 `json:"connect_time"`
+	ReadoutTime  float64 `json:"readout_time"`
+}
+
+// Publishes retained discovery configs for every peripheral once read and again whenever
+// they change (e.g. after a firmware update or reload), followed by its state as JSON.
+type homeAssistantTracker struct {
+	announced map[string]string
+}
+
+func newHomeAssistantTracker() *homeAssistantTracker {
+	return &homeAssistantTracker{announced: map[string]string{}}
+}
+
+func homeAssistantObjectID(peripheralId string) string {
+	return "miflora_" + peripheralId
+}
+
+func homeAssistantStateTopic(peripheralId string, discoveryPrefix string) string {
+	return fmt.Sprintf("%s/sensor/%s/state", discoveryPrefix, homeAssistantObjectID(peripheralId))
+}
+
+// the MAC address as "c4:7c:8d:xx:xx:xx" if the peripheral ID is derived from one
+func homeAssistantMAC(peripheralId string) string {
+	if len(peripheralId) != 12 {
+		return ""
+	}
+	parts := make([]string, 6)
+	for i := range parts {
+		parts[i] = peripheralId[2*i : 2*i+2]
+	}
+	return strings.Join(parts, ":")
+}
+
+func formatHomeAssistantDiscovery(metric mifloraDataMetric, discoveryPrefix string, availabilityTopic string) []mqttMessage {
+	objectID := homeAssistantObjectID(metric.peripheralId)
+
+	device := homeAssistantDevice{
+		Identifiers:   []string{objectID},
+		Name:          metric.labels.name,
+		Manufacturer:  "Xiaomi",
+		Model:         "Flower Care (HHCCJCY01)",
+		SWVersion:     metric.metaData.FirmwareVersion,
+		SuggestedArea: metric.labels.room,
+	}
+	if device.Name == "" {
+		device.Name = "Flower care " + metric.peripheralId
+	}
+	if mac := homeAssistantMAC(metric.peripheralId); mac != "" {
+		device.Connections = [][]string{{"mac", mac}}
+	}
+
+	// the sensor is unavailable if either miflorad or the peripheral is offline
+	availability := []homeAssistantAvailability{}
+	availabilityMode := ""
+	if availabilityTopic != "" {
+		availability = append(availability,
+			homeAssistantAvailability{Topic: availabilityTopic},
+			homeAssistantAvailability{Topic: fmt.Sprintf("%s/%s", availabilityTopic, metric.peripheralId)})
+		availabilityMode = "all"
+	}
+
+	messages := make([]mqttMessage, len(homeAssistantSensors))
+	for i, sensor := range homeAssistantSensors {
+		payload, _ := json.Marshal(homeAssistantConfig{
+			Name:              sensor.name,
+			UniqueID:          fmt.Sprintf("%s_%s", objectID, sensor.metric),
+			StateTopic:        homeAssistantStateTopic(metric.peripheralId, discoveryPrefix),
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", sensor.metric),
+			DeviceClass:       sensor.deviceClass,
+			UnitOfMeasurement: sensor.unit,
+			StateClass:        "measurement",
+			EntityCategory:    sensor.entityCategory,
+			Availability:      availability,
+			AvailabilityMode:  availabilityMode,
+			Device:            device,
+		})
+		messages[i] = mqttMessage{
+			topic:    fmt.Sprintf("%s/sensor/%s/%s/config", discoveryPrefix, objectID, sensor.metric),
+			payload:  string(payload),
+			retained: true,
+		}
+	}
+	return messages
+}
+
+// retained so Home Assistant shows the last values right after restarting
+func formatHomeAssistantState(metric mifloraDataMetric, discoveryPrefix string) mqttMessage {
+	payload, _ := json.Marshal(homeAssistantState{
+		Temperature:  metric.sensorData.Temperature,
+		Moisture:     metric.sensorData.Moisture,
+		Brightness:   metric.sensorData.Brightness,
+		Conductivity: metric.sensorData.Conductivity,
+		BatteryLevel: metric.metaData.BatteryLevel,
+		RSSI:         metric.rssi,
+		ConnectTime:  math.Round(metric.connectTime*100) / 100,
+		ReadoutTime:  math.Round(metric.readoutTime*100) / 100,
+	})
+
+	return mqttMessage{
+		topic:    homeAssistantStateTopic(metric.peripheralId, discoveryPrefix),
+		payload:  string(payload),
+		retained: true,
+	}
+}
+
+// returns the messages to publish for the metric, only data metrics have any
+func (h *homeAssistantTracker) format(metric mifloraMetric, discoveryPrefix string, availabilityTopic string) []mqttMessage {
+	data, ok := metric.(mifloraDataMetric)
+	if !ok {
+		return nil
+	}
+
+	messages := []mqttMessage{}
+	discovery := formatHomeAssistantDiscovery(data, discoveryPrefix, availabilityTopic)
+	if announced := fmt.Sprint(discovery); h.announced[data.peripheralId] != announced {
+		h.announced[data.peripheralId] = announced
+		messages = append(messages, discovery...)
+	}
+	return append(messages, formatHomeAssistantState(data, discoveryPrefix))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"testing"
+
+	common "miflorad/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatHomeAssistantDiscovery(t *testing.T) {
+	metric := mifloraDataMetric{
+		peripheralId: "c47c8d66d527",
+		labels:       peripheralLabels{name: "ficus", room: "office"},
+		metaData:     common.VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "3.2.1"},
+	}
+
+	messages := formatHomeAssistantDiscovery(metric, "homeassistant", "miflorad/availability")
+	assert.Len(t, messages, len(homeAssistantSensors))
+	assert.Equal(t, "homeassistant/sensor/miflora_c47c8d66d527/temperature/config", messages[0].topic)
+	assert.True(t, messages[0].retained)
+
+	config := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(messages[0].payload), &config))
+	assert.Equal(t, "miflora_c47c8d66d527_temperature", config["unique_id"])
+	assert.Equal(t, "homeassistant/sensor/miflora_c47c8d66d527/state", config["state_topic"])
+	assert.Equal(t, "{{ value_json.temperature }}", config["value_template"])
+	assert.Equal(t, "temperature", config["device_class"])
+	assert.Equal(t, "°C", config["unit_of_measurement"])
+	assert.Equal(t, "measurement", config["state_class"])
+	assert.Nil(t, config["entity_category"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"topic": "miflorad/availability"},
+		map[string]interface{}{"topic": "miflorad/availability/c47c8d66d527"},
+	}, config["availability"])
+	assert.Equal(t, "all", config["availability_mode"])
+	assert.Equal(t, map[string]interface{}{
+		"identifiers":    []interface{}{"miflora_c47c8d66d527"},
+		"connections":    []interface{}{[]interface{}{"mac", "c4:7c:8d:66:d5:27"}},
+		"name":           "ficus",
+		"manufacturer":   "Xiaomi",
+		"model":          "Flower Care (HHCCJCY01)",
+		"sw_version":     "3.2.1",
+		"suggested_area": "office",
+	}, config["device"])
+
+	// without availability topic and labels
+	metric = mifloraDataMetric{peripheralId: "peri"}
+	messages = formatHomeAssistantDiscovery(metric, "ha", "")
+	assert.Equal(t, "ha/sensor/miflora_peri/rssi/config", messages[5].topic)
+	assert.JSONEq(t, `{
+		"name": "Signal strength",
+		"unique_id": "miflora_peri_rssi",
+		"state_topic": "ha/sensor/miflora_peri/state",
+		"value_template": "{{ value_json.rssi }}",
+		"device_class": "signal_strength",
+		"unit_of_measurement": "dBm",
+		"state_class": "measurement",
+		"entity_category": "diagnostic",
+		"device": {
+			"identifiers": ["miflora_peri"],
+			"name": "Flower care peri",
+			"manufacturer": "Xiaomi",
+			"model": "Flower Care (HHCCJCY01)"
+		}
+	}`, messages[5].payload)
+}
+
+func TestFormatHomeAssistantState(t *testing.T) {
+	metric := mifloraDataMetric{
+		peripheralId: "peri",
+		metaData:     common.VersionBatteryResponse{BatteryLevel: 99},
+		sensorData:   common.SensorDataResponse{Temperature: 21.5, Brightness: 1500, Moisture: 35, Conductivity: 420},
+		connectTime:  1.2345,
+		readoutTime:  0.5,
+		rssi:         -60,
+	}
+
+	message := formatHomeAssistantState(metric, "homeassistant")
+	assert.Equal(t, "homeassistant/sensor/miflora_peri/state", message.topic)
+	assert.True(t, message.retained)
+	assert.JSONEq(t, `{"temperature":21.5,"moisture":35,"brightness":1500,"conductivity":420,`+
+		`"battery_level":99,"rssi":-60,"connect_time":1.23,"readout_time":0.5}`, message.payload)
+}
+
+func TestHomeAssistantTracker(t *testing.T) {
+	tracker := newHomeAssistantTracker()
+	metric := mifloraDataMetric{peripheralId: "peri", metaData: common.VersionBatteryResponse{FirmwareVersion: "3.2.1"}}
+
+	assert.Len(t, tracker.format(metric, "ha", ""), len(homeAssistantSensors)+1)
+	// only the state is published as long as nothing changed
+	messages := tracker.format(metric, "ha", "")
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "ha/sensor/miflora_peri/state", messages[0].topic)
+
+	metric.metaData.FirmwareVersion = "3.2.2"
+	assert.Len(t, tracker.format(metric, "ha", ""), len(homeAssistantSensors)+1)
+	assert.Len(t, tracker.format(metric, "ha", "miflorad/availability"), len(homeAssistantSensors)+1)
+
+	assert.Empty(t, tracker.format(mifloraErrorMetric{peripheralId: "peri", failed: 1}, "ha", ""))
+}
+
+func TestFormatMetricsHomeAssistant(t *testing.T) {
+	defer flag.Set("homeassistantprefix", "")
+	flag.Set("homeassistantprefix", "homeassistant")
+
+	send := make(chan mifloraMetric, 10)
+	publish := make(chan metricLine, 100)
+	messages := make(chan mqttMessage, 100)
+
+	send <- mifloraDataMetric{peripheralId: "peri"}
+	send <- mifloraDataMetric{peripheralId: "peri"}
+	close(send)
+	formatMetrics(graphiteFormat, send, publish, messages)
+	close(messages)
+
+	topics := []string{}
+	for message := range messages {
+		topics = append(topics, message.topic)
+	}
+	// availability, discovery configs and the state followed by the state only
+	assert.Len(t, topics, 1+len(homeAssistantSensors)+1+1)
+	assert.Equal(t, "miflorad/availability/peri", topics[0])
+	assert.Equal(t, "homeassistant/sensor/miflora_peri/temperature/config", topics[1])
+	assert.Equal(t, "homeassistant/sensor/miflora_peri/state", topics[len(topics)-1])
+	assert.Equal(t, "homeassistant/sensor/miflora_peri/state", topics[len(topics)-2])
+	assert.NotEmpty(t, publish)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	homieVersion      = "4.0"
+	homieInit         = "init"
+	homieReady        = "ready"
+	homieDisconnected = "disconnected"
+	homieLost         = "lost"
+)
+
+// a Homie property per metric of mifloraDataMetric
+type homieProperty struct {
+	id       string
+	name     string
+	datatype string
+	unit     string
+	format   string
+}
+
+var homieProperties = []homieProperty{
+	{"temperature", "Temperature", "float", "°C", ""},
+	{"moisture", "Moisture", "integer", "%", "0:100"},
+	{"brightness", "Brightness", "integer", "lx", ""},
+	{"conductivity", "Conductivity", "integer", "µS/cm", ""},
+	{"battery-level", "Battery level", "integer", "%", "0:100"},
+	{"firmware-version", "Firmware version", "string", "", ""},
+	{"rssi", "Signal strength", "integer", "dBm", ""},
+	{"connect-time", "Connect time", "float", "s", ""},
+	{"readout-time", "Readout time", "float", "s", ""},
+}
+
+var invalidHomieIDChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// topic IDs may only consist of lowercase letters, digits and hyphens
+func homieID(name string) string {
+	id := strings.Trim(invalidHomieIDChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if id == "" {
+		return "miflorad"
+	}
+	return id
+}
+
+// The gateway as Homie device (see https://homieiot.github.io/specification/spec-core-v4_0_0/)
+// with a node per peripheral. The device is described once the first node is read and again
+// whenever a node is added or changed, the $state topic is the Last Will of the connection.
+type homieDevice struct {
+	baseTopic string
+	id        string
+	name      string
+
+	// guards the fields below which are also accessed on connect
+	lock  sync.Mutex
+	nodes []string
+	names map[string]string
+	ready bool
+}
+
+// only set with the homie publish format, base topic and device can't be changed on reload
+var homie *homieDevice
+
+func newHomieDevice(baseTopic string, name string) *homieDevice {
+	return &homieDevice{
+		baseTopic: baseTopic,
+		id:        homieID(name),
+		name:      name,
+		names:     map[string]string{},
+	}
+}
+
+func (d *homieDevice) topic(attribute string) string {
+	return fmt.Sprintf("%s/%s/%s", d.baseTopic, d.id, attribute)
+}
+
+func (d *homieDevice) stateTopic() string {
+	return d.topic("$state")
+}
+
+// the state to publish after (re)connecting, the device is only ready once described
+func (d *homieDevice) connectState() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.ready {
+		return homieReady
+	}
+	return homieInit
+}
+
+// the messages describing the device and the node of the metric if that is new or changed
+func (d *homieDevice) describe(metric mifloraMetric) []mqttMessage {
+	if _, ok := metric.(mifloraDataMetric); !ok {
+		return nil
+	}
+	node := metric.getPeripheralId()
+	name := metric.getLabels().name
+	if name == "" {
+		name = "Flower care " + node
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	known, nodeKnown := d.names[node]
+	if nodeKnown && known == name {
+		return nil
+	}
+	if !nodeKnown {
+		d.nodes = append(d.nodes, node)
+	}
+	d.names[node] = name
+	d.ready = true
+
+	messages := []mqttMessage{}
+	add := func(topic string, payload string) {
+		messages = append(messages, mqttMessage{topic: topic, payload: payload, retained: true})
+	}
+
+	add(d.stateTopic(), homieInit)
+	add(d.topic("$homie"), homieVersion)
+	add(d.topic("$name"), d.name)
+	add(d.topic("$extensions"), "")
+	add(d.topic("$nodes"), strings.Join(d.nodes, ","))
+
+	propertyIDs := make([]string, len(homieProperties))
+	for i, property := range homieProperties {
+		propertyIDs[i] = property.id
+	}
+	add(d.topic(node+"/$name"), name)
+	add(d.topic(node+"/$type"), "Flower Care")
+	add(d.topic(node+"/$properties"), strings.Join(propertyIDs, ","))
+
+	for _, property := range homieProperties {
+		add(d.topic(node+"/"+property.id+"/$name"), property.name)
+		add(d.topic(node+"/"+property.id+"/$datatype"), property.datatype)
+		if property.unit != "" {
+			add(d.topic(node+"/"+property.id+"/$unit"), property.unit)
+		}
+		if property.format != "" {
+			add(d.topic(node+"/"+property.id+"/$format"), property.format)
+		}
+	}
+
+	add(d.stateTopic(), homieReady)
+	return messages
+}
+
+// the retained property values of data metrics, other metrics have no properties
+func formatHomie(metric mifloraMetric, device *homieDevice) []metricLine {
+	data, ok := metric.(mifloraDataMetric)
+	if !ok {
+		return nil
+	}
+
+	values := map[string]string{
+		"temperature":      fmt.Sprintf("%.1f", data.sensorData.Temperature),
+		"moisture":         fmt.Sprintf("%d", data.sensorData.Moisture),
+		"brightness":       fmt.Sprintf("%d", data.sensorData.Brightness),
+		"conductivity":     fmt.Sprintf("%d", data.sensorData.Conductivity),
+		"battery-level":    fmt.Sprintf("%d", data.metaData.BatteryLevel),
+		"firmware-version": data.metaData.FirmwareVersion,
+		"rssi":             fmt.Sprintf("%d", data.rssi),
+		"connect-time":     fmt.Sprintf("%.2f", data.connectTime),
+		"readout-time":     fmt.Sprintf("%.2f", data.readoutTime),
+	}
+
+	lines := []metricLine{}
+	for _, property := range homieProperties {
+		// passive mode knows no firmware version
+		if values[property.id] == "" {
+			continue
+		}
+		lines = append(lines, metricLine{
+			peripheralId: data.peripheralId,
+			line:         values[property.id],
+			topic:        device.topic(data.peripheralId + "/" + property.id),
+			retained:     true,
+		})
+	}
+	return lines
+}
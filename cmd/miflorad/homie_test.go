@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	common "miflorad/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHomieID(t *testing.T) {
+	assert.Equal(t, "gateway-office", homieID("Gateway.Office"))
+	assert.Equal(t, "pi-4", homieID("_pi 4_"))
+	assert.Equal(t, "miflorad", homieID("#"))
+}
+
+func TestHomieDeviceDescribe(t *testing.T) {
+	device := newHomieDevice("homie", "gw")
+	assert.Equal(t, homieInit, device.connectState())
+	assert.Empty(t, device.describe(mifloraErrorMetric{peripheralId: "peri", failed: 1}))
+
+	messages := device.describe(mifloraDataMetric{peripheralId: "peri", labels: peripheralLabels{name: "ficus"}})
+	payloads := map[string]string{}
+	for _, message := range messages {
+		assert.True(t, message.retained)
+		payloads[message.topic] = message.payload
+	}
+	assert.Equal(t, mqttMessage{topic: "homie/gw/$state", payload: "init", retained: true}, messages[0])
+	assert.Equal(t, mqttMessage{topic: "homie/gw/$state", payload: "ready", retained: true}, messages[len(messages)-1])
+	assert.Equal(t, "4.0", payloads["homie/gw/$homie"])
+	assert.Equal(t, "gw", payloads["homie/gw/$name"])
+	assert.Equal(t, "", payloads["homie/gw/$extensions"])
+	assert.Equal(t, "peri", payloads["homie/gw/$nodes"])
+	assert.Equal(t, "ficus", payloads["homie/gw/peri/$name"])
+	assert.Equal(t, "Flower Care", payloads["homie/gw/peri/$type"])
+	assert.Equal(t, "temperature,moisture,brightness,conductivity,battery-level,firmware-version,rssi,connect-time,readout-time",
+		payloads["homie/gw/peri/$properties"])
+	assert.Equal(t, "float", payloads["homie/gw/peri/temperature/$datatype"])
+	assert.Equal(t, "°C", payloads["homie/gw/peri/temperature/$unit"])
+	assert.Equal(t, "0:100", payloads["homie/gw/peri/moisture/$format"])
+	assert.Equal(t, "string", payloads["homie/gw/peri/firmware-version/$datatype"])
+	assert.NotContains(t, payloads, "homie/gw/peri/firmware-version/$unit")
+	assert.Equal(t, homieReady, device.connectState())
+
+	// described again only once nodes are added or changed
+	assert.Empty(t, device.describe(mifloraDataMetric{peripheralId: "peri", labels: peripheralLabels{name: "ficus"}}))
+	messages = device.describe(mifloraDataMetric{peripheralId: "other"})
+	assert.Contains(t, messages, mqttMessage{topic: "homie/gw/$nodes", payload: "peri,other", retained: true})
+	assert.Contains(t, messages, mqttMessage{topic: "homie/gw/other/$name", payload: "Flower care other", retained: true})
+	messages = device.describe(mifloraDataMetric{peripheralId: "peri", labels: peripheralLabels{name: "cactus"}})
+	assert.Contains(t, messages, mqttMessage{topic: "homie/gw/$nodes", payload: "peri,other", retained: true})
+	assert.Contains(t, messages, mqttMessage{topic: "homie/gw/peri/$name", payload: "cactus", retained: true})
+}
+
+func TestFormatHomie(t *testing.T) {
+	device := newHomieDevice("homie", "gw")
+	metric := mifloraDataMetric{
+		peripheralId: "peri",
+		metaData:     common.VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "3.2.1"},
+		sensorData:   common.SensorDataResponse{Temperature: 21.5, Brightness: 1500, Moisture: 35, Conductivity: 420},
+		connectTime:  1.234,
+		readoutTime:  0.5,
+		rssi:         -60,
+	}
+
+	line := func(property string, value string) metricLine {
+		return metricLine{peripheralId: "peri", line: value, topic: "homie/gw/peri/" + property, retained: true}
+	}
+	assert.Equal(t, []metricLine{
+		line("temperature", "21.5"),
+		line("moisture", "35"),
+		line("brightness", "1500"),
+		line("conductivity", "420"),
+		line("battery-level", "99"),
+		line("firmware-version", "3.2.1"),
+		line("rssi", "-60"),
+		line("connect-time", "1.23"),
+		line("readout-time", "0.50"),
+	}, formatHomie(metric, device))
+
+	metric.metaData.FirmwareVersion = ""
+	assert.Len(t, formatHomie(metric, device), len(homieProperties)-1)
+	assert.Empty(t, formatHomie(mifloraSkippedMetric{peripheralId: "peri", skipped: 1}, device))
+}
+
+func TestFormatMetricsHomie(t *testing.T) {
+	defer func() { homie = nil }()
+	homie = newHomieDevice("homie", "gw")
+
+	send := make(chan mifloraMetric, 10)
+	publish := make(chan metricLine, 100)
+	messages := make(chan mqttMessage, 100)
+
+	send <- mifloraDataMetric{peripheralId: "peri"}
+	send <- mifloraDataMetric{peripheralId: "peri"}
+	close(send)
+	formatMetrics(homieFormat, send, publish, messages)
+	close(publish)
+	close(messages)
+
+	described := 0
+	for message := range messages {
+		if message.topic == "homie/gw/$homie" {
+			described++
+		}
+	}
+	assert.Equal(t, 1, described)
+	lines := []metricLine{}
+	for line := range publish {
+		lines = append(lines, line)
+	}
+	assert.Len(t, lines, 2*(len(homieProperties)-1))
+	assert.Equal(t, "homie/gw/peri/temperature", lines[0].topic)
+	// values carry no timestamp
+	assert.Equal(t, *interval, lines[0].validFor)
+}
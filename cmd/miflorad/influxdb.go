@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	influxWriteTimeout = 10 * time.Second
+	// delay between attempts to write a batch while InfluxDB is unreachable
+	influxMinRetryDelay = 1 * time.Second
+	influxMaxRetryDelay = 1 * time.Minute
+	// batches kept buffered for retrying, the oldest lines are dropped beyond
+	influxBufferedBatches = 100
+)
+
+var influxPrecisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// settings of the InfluxDB sink, changing them requires a restart
+type influxSettings struct {
+	url           string
+	database      string
+	user          string
+	password      string
+	org           string
+	bucket        string
+	token         string
+	precision     string
+	batchSize     int
+	flushInterval time.Duration
+	gzip          bool
+}
+
+func currentInfluxSettings() influxSettings {
+	return influxSettings{
+		url:           *influxURL,
+		database:      *influxDatabase,
+		user:          *influxUser,
+		password:      *influxPassword,
+		org:           *influxOrg,
+		bucket:        *influxBucket,
+		token:         *influxToken,
+		precision:     *influxPrecision,
+		batchSize:     *influxBatchSize,
+		flushInterval: *influxFlushInterval,
+		gzip:          *influxGzip,
+	}
+}
+
+// the write endpoint of the v2 API if a bucket is given, else the one of the v1 API
+func (s influxSettings) writeURL() (string, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid InfluxDB URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.Errorf("Unsupported InfluxDB URL scheme %s", u.Scheme)
+	}
+
+	query := url.Values{}
+	switch {
+	case s.bucket != "":
+		u = u.JoinPath("api/v2/write")
+		query.Set("org", s.org)
+		query.Set("bucket", s.bucket)
+		query.Set("precision", s.precision)
+	case s.database != "":
+		u = u.JoinPath("write")
+		query.Set("db", s.database)
+		// the v1 API calls microseconds u
+		if s.precision == "us" {
+			query.Set("precision", "u")
+		} else {
+			query.Set("precision", s.precision)
+		}
+	default:
+		return "", errors.New("Neither InfluxDB database nor bucket given")
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// A batching writer of line protocol lines to InfluxDB. Lines are buffered in memory and
+// written once a batch is full or the flush interval passed, failed writes are retried
+// with increasing delay unless InfluxDB rejected the lines.
+type influxWriter struct {
+	settings  influxSettings
+	writeURL  string
+	precision time.Duration
+	client    *http.Client
+	// retry delays, only changed by tests
+	minRetryDelay time.Duration
+	maxRetryDelay time.Duration
+
+	// guards buffer, flush is signalled once a batch is full
+	lock    sync.Mutex
+	buffer  []metricLine
+	flush   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// only set if the InfluxDB sink is enabled
+var influxSink *influxWriter
+
+func newInfluxWriter(settings influxSettings) (*influxWriter, error) {
+	precision, ok := influxPrecisions[settings.precision]
+	if !ok {
+		return nil, errors.Errorf("Invalid InfluxDB precision %s", settings.precision)
+	}
+	if settings.batchSize <= 0 {
+		return nil, errors.Errorf("Invalid InfluxDB batch size %d", settings.batchSize)
+	}
+	if settings.flushInterval <= 0 {
+		return nil, errors.Errorf("Invalid InfluxDB flush interval %s", settings.flushInterval)
+	}
+	writeURL, err := settings.writeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	return &influxWriter{
+		settings:      settings,
+		writeURL:      writeURL,
+		precision:     precision,
+		client:        &http.Client{Timeout: influxWriteTimeout},
+		minRetryDelay: influxMinRetryDelay,
+		maxRetryDelay: influxMaxRetryDelay,
+		flush:         make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}, nil
+}
+
+func (w *influxWriter) add(line metricLine) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buffer = append(w.buffer, line)
+	if maxBuffered := influxBufferedBatches * w.settings.batchSize; len(w.buffer) > maxBuffered {
+		dropped := w.buffer[0]
+		w.buffer = w.buffer[1:]
+		fmt.Fprintf(os.Stderr, "Dropping InfluxDB line of peripheral %s, buffer limit exceeded\n", dropped.peripheralId)
+		recordPublishFailure(dropped.peripheralId)
+	}
+	if len(w.buffer) >= w.settings.batchSize {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// the oldest lines up to the batch size, they are kept buffered until written
+func (w *influxWriter) nextBatch() []metricLine {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	size := len(w.buffer)
+	if size > w.settings.batchSize {
+		size = w.settings.batchSize
+	}
+	return append([]metricLine{}, w.buffer[:size]...)
+}
+
+func (w *influxWriter) removeBatch(batch []metricLine) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// the oldest lines of the batch may have been dropped from the buffer meanwhile
+	for _, line := range batch {
+		if len(w.buffer) > 0 && w.buffer[0] == line {
+			w.buffer = w.buffer[1:]
+		}
+	}
+}
+
+// an error InfluxDB will answer again if the same lines are written again
+type influxRejectedError struct {
+	status int
+	body   string
+}
+
+func (e *influxRejectedError) Error() string {
+	return fmt.Sprintf("InfluxDB rejected the write with status %d: %s", e.status, e.body)
+}
+
+func (w *influxWriter) write(batch []metricLine) error {
+	var body bytes.Buffer
+	var writer io.Writer = &body
+	var gzipWriter *gzip.Writer
+	if w.settings.gzip {
+		gzipWriter = gzip.NewWriter(&body)
+		writer = gzipWriter
+	}
+	for _, line := range batch {
+		io.WriteString(writer, line.line+"\n")
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return errors.Wrap(err, "can't compress lines")
+		}
+	}
+
+	request, err := http.NewRequest(http.MethodPost, w.writeURL, &body)
+	if err != nil {
+		return errors.Wrap(err, "can't create InfluxDB request")
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.settings.gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	if w.settings.token != "" {
+		request.Header.Set("Authorization", "Token "+w.settings.token)
+	} else if w.settings.user != "" {
+		request.SetBasicAuth(w.settings.user, w.settings.password)
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return errors.Wrap(err, "can't write to InfluxDB")
+	}
+	defer response.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode >= 400 && response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests:
+		return &influxRejectedError{status: response.StatusCode, body: strings.TrimSpace(string(message))}
+	default:
+		return errors.Errorf("InfluxDB write failed with status %d: %s", response.StatusCode, strings.TrimSpace(string(message)))
+	}
+}
+
+// writes all buffered batches, failed writes are retried until closed if retry is set
+func (w *influxWriter) writeBuffered(retry bool) {
+	retryDelay := w.minRetryDelay
+	for {
+		batch := w.nextBatch()
+		if len(batch) == 0 {
+			return
+		}
+
+		err := w.write(batch)
+		var rejectedErr *influxRejectedError
+		if err != nil && !errors.As(err, &rejectedErr) {
+			fmt.Fprintf(os.Stderr, "Failed to write %d line(s) to InfluxDB, err: %s\n", len(batch), err)
+			if !retry {
+				return
+			}
+			select {
+			case <-time.After(retryDelay):
+			case <-w.done:
+				return
+			}
+			retryDelay *= 2
+			if retryDelay > w.maxRetryDelay {
+				retryDelay = w.maxRetryDelay
+			}
+			continue
+		}
+		retryDelay = w.minRetryDelay
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Dropping %d line(s), err: %s\n", len(batch), err)
+			for _, line := range batch {
+				recordPublishFailure(line.peripheralId)
+			}
+		}
+		w.removeBatch(batch)
+	}
+}
+
+// writes batches until closed, then attempts to write the remaining lines once
+func (w *influxWriter) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.settings.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flush:
+		case <-w.done:
+			w.writeBuffered(false)
+			return
+		}
+		w.writeBuffered(true)
+	}
+}
+
+func (w *influxWriter) close() {
+	close(w.done)
+	<-w.stopped
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type influxRequest struct {
+	path          string
+	query         string
+	authorization string
+	encoding      string
+	body          string
+}
+
+// stands in for InfluxDB answering the given status codes in turn and 204 afterwards
+type fakeInflux struct {
+	lock     sync.Mutex
+	statuses []int
+	requests []influxRequest
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reader = gzipReader
+	}
+	body, _ := io.ReadAll(reader)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, influxRequest{
+		path:          r.URL.Path,
+		query:         r.URL.RawQuery,
+		authorization: r.Header.Get("Authorization"),
+		encoding:      r.Header.Get("Content-Encoding"),
+		body:          string(body),
+	})
+	status := http.StatusNoContent
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (f *fakeInflux) received() []influxRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]influxRequest{}, f.requests...)
+}
+
+func TestInfluxSettingsWriteURL(t *testing.T) {
+	tables := []struct {
+		settings influxSettings
+		expected string
+	}{
+		{influxSettings{url: "http://localhost:8086", database: "plants", precision: "s"}, "http://localhost:8086/write?db=plants&precision=s"},
+		{influxSettings{url: "http://localhost:8086/influx/", database: "plants", precision: "us"}, "http://localhost:8086/influx/write?db=plants&precision=u"},
+		{influxSettings{url: "https://influx.example.com", org: "example", bucket: "plants", precision: "us"},
+			"https://influx.example.com/api/v2/write?bucket=plants&org=example&precision=us"},
+	}
+
+	for _, table := range tables {
+		writeURL, err := table.settings.writeURL()
+		assert.NoError(t, err)
+		assert.Equal(t, table.expected, writeURL)
+	}
+
+	_, err := influxSettings{url: "http://localhost:8086"}.writeURL()
+	assert.Error(t, err)
+	_, err = influxSettings{url: "tcp://localhost:8086", database: "plants"}.writeURL()
+	assert.Error(t, err)
+}
+
+func TestNewInfluxWriterInvalid(t *testing.T) {
+	valid := influxSettings{url: "http://localhost:8086", database: "plants", precision: "s", batchSize: 1, flushInterval: 10 * time.Second}
+	_, err := newInfluxWriter(valid)
+	assert.NoError(t, err)
+
+	invalid := valid
+	invalid.precision = "m"
+	_, err = newInfluxWriter(invalid)
+	assert.Error(t, err)
+	invalid = valid
+	invalid.batchSize = 0
+	_, err = newInfluxWriter(invalid)
+	assert.Error(t, err)
+	invalid = valid
+	invalid.flushInterval = 0
+	_, err = newInfluxWriter(invalid)
+	assert.Error(t, err)
+	invalid.flushInterval = -1 * time.Second
+	_, err = newInfluxWriter(invalid)
+	assert.Error(t, err)
+}
+
+func TestInfluxWriterV1(t *testing.T) {
+	influx := &fakeInflux{}
+	server := httptest.NewServer(influx)
+	defer server.Close()
+
+	writer, err := newInfluxWriter(influxSettings{
+		url: server.URL, database: "plants", user: "miflorad", password: "secret",
+		precision: "s", batchSize: 2, flushInterval: 1 * time.Hour, gzip: true,
+	})
+	assert.NoError(t, err)
+	go writer.run()
+
+	// full batches are written right away
+	writer.add(metricLine{peripheralId: "peri", line: "miflora,id=peri moisture=16 1500000000"})
+	writer.add(metricLine{peripheralId: "peri", line: "miflora,id=peri moisture=17 1500000060"})
+	assert.Eventually(t, func() bool { return len(influx.received()) == 1 }, 1*time.Second, 10*time.Millisecond)
+
+	// the rest is written on close
+	writer.add(metricLine{peripheralId: "peri", line: "miflora,id=peri moisture=18 1500000120"})
+	writer.close()
+
+	requests := influx.received()
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "/write", requests[0].path)
+	assert.Equal(t, "db=plants&precision=s", requests[0].query)
+	assert.Equal(t, "Basic bWlmbG9yYWQ6c2VjcmV0", requests[0].authorization)
+	assert.Equal(t, "gzip", requests[0].encoding)
+	assert.Equal(t, "miflora,id=peri moisture=16 1500000000\nmiflora,id=peri moisture=17 1500000060\n", requests[0].body)
+	assert.Equal(t, "miflora,id=peri moisture=18 1500000120\n", requests[1].body)
+}
+
+func TestInfluxWriterV2Retry(t *testing.T) {
+	influx := &fakeInflux{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(influx)
+	defer server.Close()
+
+	writer, err := newInfluxWriter(influxSettings{
+		url: server.URL, org: "example", bucket: "plants", token: "secret-token",
+		precision: "ns", batchSize: 10, flushInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	writer.minRetryDelay = 10 * time.Millisecond
+	go writer.run()
+
+	writer.add(metricLine{peripheralId: "peri", line: "miflora,id=peri moisture=16 1500000000000000000"})
+	assert.Eventually(t, func() bool { return len(influx.received()) == 3 }, 1*time.Second, 10*time.Millisecond)
+	writer.close()
+
+	requests := influx.received()
+	assert.Len(t, requests, 3)
+	for _, request := range requests {
+		assert.Equal(t, "/api/v2/write", request.path)
+		assert.Equal(t, "bucket=plants&org=example&precision=ns", request.query)
+		assert.Equal(t, "Token secret-token", request.authorization)
+		assert.Equal(t, "", request.encoding)
+		assert.Equal(t, "miflora,id=peri moisture=16 1500000000000000000\n", request.body)
+	}
+}
+
+func TestInfluxWriterRejected(t *testing.T) {
+	influx := &fakeInflux{statuses: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(influx)
+	defer server.Close()
+
+	writer, err := newInfluxWriter(influxSettings{url: server.URL, database: "plants", precision: "s", batchSize: 1, flushInterval: 1 * time.Hour})
+	assert.NoError(t, err)
+	go writer.run()
+
+	// rejected lines are dropped and counted as publish failures
+	writer.add(metricLine{peripheralId: "rejected", line: "invalid"})
+	assert.Eventually(t, func() bool { return len(influx.received()) == 1 }, 1*time.Second, 10*time.Millisecond)
+	writer.add(metricLine{peripheralId: "peri", line: "miflora,id=peri moisture=16 1500000000"})
+	assert.Eventually(t, func() bool { return len(influx.received()) == 2 }, 1*time.Second, 10*time.Millisecond)
+	writer.close()
+
+	assert.Equal(t, "miflora,id=peri moisture=16 1500000000\n", influx.received()[1].body)
+	assert.Equal(t, 1, takePublishFailures("rejected"))
+}
+
+func TestInfluxWriterBufferLimit(t *testing.T) {
+	writer, err := newInfluxWriter(influxSettings{url: "http://localhost:8086", database: "plants", precision: "s", batchSize: 1, flushInterval: 1 * time.Hour})
+	assert.NoError(t, err)
+
+	for i := 0; i <= influxBufferedBatches; i++ {
+		writer.add(metricLine{peripheralId: "limited", line: strings.Repeat("x", i+1)})
+	}
+	assert.Len(t, writer.buffer, influxBufferedBatches)
+	assert.Equal(t, "xx", writer.buffer[0].line)
+	assert.Equal(t, 1, takePublishFailures("limited"))
+}
+
+func TestFormatInfluxPrecision(t *testing.T) {
+	now := time.Unix(1500000000, 123456789)
+	metric := mifloraSkippedMetric{peripheralId: "peri", skipped: 2}
+
+	assert.Equal(t, "miflora,id=peri skipped_readings=2 1500000000123456789", formatInflux(metric, now, time.Nanosecond))
+	assert.Equal(t, "miflora,id=peri skipped_readings=2 1500000000123", formatInflux(metric, now, time.Millisecond))
+	assert.Equal(t, "miflora,id=peri skipped_readings=2 1500000000", formatInflux(metric, now, time.Second))
+}
+
+func TestInfluxWriterRemoveBatch(t *testing.T) {
+	writer, err := newInfluxWriter(influxSettings{url: "http://localhost:8086", database: "plants", precision: "s", batchSize: 2, flushInterval: 1 * time.Hour})
+	assert.NoError(t, err)
+
+	writer.add(metricLine{line: "a"})
+	writer.add(metricLine{line: "b"})
+	batch := writer.nextBatch()
+	writer.add(metricLine{line: "c"})
+	// a was dropped while writing the batch
+	writer.buffer = writer.buffer[1:]
+
+	writer.removeBatch(batch)
+	assert.Equal(t, []metricLine{{line: "c"}}, writer.buffer)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	common "miflorad/common"
+)
+
+// the device name and appearance will not change often
+const sensorInfoInterval = 24 * time.Hour
+
+// captures what is known about a peripheral for asset tracking
+type mifloraInventoryMetric struct {
+	peripheralId string
+	labels       peripheralLabels
+	address      string // as "C4:7C:8D:xx:xx:xx"
+	info         common.SensorInfo
+	firstSeen    time.Time
+	lastSeen     time.Time
+}
+
+func (m mifloraInventoryMetric) getPeripheralId() string {
+	return m.peripheralId
+}
+
+func (m mifloraInventoryMetric) getLabels() peripheralLabels {
+	return m.labels
+}
+
+// a message to be published on a topic other than the metrics topic
+type mqttMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+type inventoryRecord struct {
+	Address         string `json:"address"`
+	Name            string `json:"name,omitempty"`
+	Room            string `json:"room,omitempty"`
+	Plant           string `json:"plant,omitempty"`
+	DeviceName      string `json:"device_name"`
+	Appearance      uint16 `json:"appearance"`
+	FirmwareVersion string `json:"firmware_version"`
+	FirstSeen       string `json:"first_seen"`
+	LastSeen        string `json:"last_seen"`
+	Adapter         string `json:"adapter"`
+}
+
+// first seen times of earlier runs by peripheral ID, taken from the retained inventory records
+var (
+	retainedFirstSeenLock sync.Mutex
+	retainedFirstSeen     = map[string]time.Time{}
+)
+
+// remembers the first seen time of a retained inventory record so it survives restarts
+func rememberFirstSeen(payload []byte) {
+	var record inventoryRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		fmt.Fprintf(os.Stderr, "Ignoring invalid inventory record, err: %s\n", err)
+		return
+	}
+	firstSeen, err := time.Parse(time.RFC3339, record.FirstSeen)
+	if err != nil || record.Address == "" {
+		fmt.Fprintf(os.Stderr, "Ignoring inventory record without address or first seen time\n")
+		return
+	}
+
+	retainedFirstSeenLock.Lock()
+	defer retainedFirstSeenLock.Unlock()
+
+	id := common.MifloraGetAlphaNumericID(record.Address)
+	if known, ok := retainedFirstSeen[id]; !ok || firstSeen.Before(known) {
+		retainedFirstSeen[id] = firstSeen
+	}
+}
+
+// the earlier of the first seen time of this and any earlier run
+func (p *peripheral) earliestSeen() time.Time {
+	retainedFirstSeenLock.Lock()
+	defer retainedFirstSeenLock.Unlock()
+
+	if known, ok := retainedFirstSeen[common.MifloraGetAlphaNumericID(p.id)]; ok && known.Before(p.firstSeen) {
+		return known
+	}
+	return p.firstSeen
+}
+
+func (p *peripheral) markSeen(now time.Time) {
+	if p.firstSeen.IsZero() {
+		p.firstSeen = now
+	}
+	p.lastSeen = now
+}
+
+// sends an inventory metric for every peripheral that has been seen at least once
+func sendInventory(send chan mifloraMetric) {
+	passiveLock.Lock()
+	peripherals := append([]*peripheral{}, allPeripherals...)
+	passiveLock.Unlock()
+
+	sendInventoryOf(send, peripherals)
+}
+
+// sends an inventory metric for the given peripherals if seen at least once, the lock
+// is not held while sending to not stall the scanning on a slow publisher
+func sendInventoryOf(send chan mifloraMetric, peripherals []*peripheral) {
+	metrics := []mifloraInventoryMetric{}
+
+	passiveLock.Lock()
+	for _, peripheral := range peripherals {
+		if peripheral.lastSeen.IsZero() {
+			continue
+		}
+		peripheral.firstSeen = peripheral.earliestSeen()
+
+		info := peripheral.info
+		// meta data is refreshed more often than the sensor info
+		if peripheral.metaData.FirmwareVersion != "" {
+			info.FirmwareVersion = peripheral.metaData.FirmwareVersion
+		}
+
+		metrics = append(metrics, mifloraInventoryMetric{
+			peripheralId: common.MifloraGetAlphaNumericID(peripheral.id),
+			labels:       peripheral.labels,
+			address:      peripheral.id,
+			info:         info,
+			firstSeen:    peripheral.firstSeen,
+			lastSeen:     peripheral.lastSeen,
+		})
+	}
+	passiveLock.Unlock()
+
+	for _, metric := range metrics {
+		send <- metric
+	}
+}
+
+func getAdapterName() string {
+	if *adapterName != "" {
+		return *adapterName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+func formatInventory(metric mifloraInventoryMetric, topicPrefix string, adapter string) mqttMessage {
+	payload, _ := json.Marshal(inventoryRecord{
+		Address:         metric.address,
+		Name:            metric.labels.name,
+		Room:            metric.labels.room,
+		Plant:           metric.labels.plant,
+		DeviceName:      metric.info.DeviceName,
+		Appearance:      metric.info.Appearance,
+		FirmwareVersion: metric.info.FirmwareVersion,
+		FirstSeen:       metric.firstSeen.UTC().Format(time.RFC3339),
+		LastSeen:        metric.lastSeen.UTC().Format(time.RFC3339),
+		Adapter:         adapter,
+	})
+
+	return mqttMessage{
+		topic:    fmt.Sprintf("%s/%s", topicPrefix, metric.peripheralId),
+		payload:  string(payload),
+		retained: true,
+	}
+}
+
+// publishes all messages received from messages until it is closed
+func publishMessages(broker *brokerConnection, messages chan mqttMessage) {
+	for message := range messages {
+		if err := broker.publish(message.topic, message.retained, message.payload); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to publish MQTT, err: %s\n", err)
+			continue
+		}
+	}
+}
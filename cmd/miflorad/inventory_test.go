@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	common "miflorad/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendInventory(t *testing.T) {
+	firstSeen := time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)
+	lastSeen := time.Date(2020, 4, 2, 10, 0, 0, 0, time.UTC)
+	seen := &peripheral{
+		id:        "C4:7C:8D:66:D5:27",
+		metaData:  common.VersionBatteryResponse{BatteryLevel: 100, FirmwareVersion: "3.2.2"},
+		info:      common.SensorInfo{DeviceName: "Flower care", FirmwareVersion: "3.2.1"},
+		firstSeen: firstSeen,
+		lastSeen:  lastSeen,
+	}
+	unseen := &peripheral{
+		id: "C4:7C:8D:66:D5:28",
+	}
+	allPeripherals = []*peripheral{seen, unseen}
+	defer func() { allPeripherals = nil }()
+
+	send := make(chan mifloraMetric, 10)
+	sendInventory(send)
+
+	assert.Equal(t, []mifloraMetric{mifloraInventoryMetric{
+		peripheralId: "c47c8d66d527",
+		address:      "C4:7C:8D:66:D5:27",
+		info:         common.SensorInfo{DeviceName: "Flower care", FirmwareVersion: "3.2.2"},
+		firstSeen:    firstSeen,
+		lastSeen:     lastSeen,
+	}}, receiveMetrics(send))
+}
+
+func TestSendInventoryFirstSeenOfEarlierRun(t *testing.T) {
+	defer func() { retainedFirstSeen = map[string]time.Time{} }()
+	seen := &peripheral{
+		id:        "C4:7C:8D:66:D5:27",
+		firstSeen: time.Date(2020, 4, 2, 10, 0, 0, 0, time.UTC),
+		lastSeen:  time.Date(2020, 4, 2, 10, 0, 0, 0, time.UTC),
+	}
+	allPeripherals = []*peripheral{seen}
+	defer func() { allPeripherals = nil }()
+
+	rememberFirstSeen([]byte(`{"address":"C4:7C:8D:66:D5:27","first_seen":"2020-04-01T10:00:00Z","last_seen":"2020-04-01T12:00:00Z"}`))
+	rememberFirstSeen([]byte(`{"address":"C4:7C:8D:66:D5:27","first_seen":"2020-04-01T11:00:00Z"}`))
+	rememberFirstSeen([]byte(`{"address":"C4:7C:8D:66:D5:27"}`))
+	rememberFirstSeen([]byte(`fubar`))
+
+	send := make(chan mifloraMetric, 10)
+	sendInventory(send)
+	metrics := receiveMetrics(send)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC), metrics[0].(mifloraInventoryMetric).firstSeen)
+	assert.Equal(t, time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC), seen.firstSeen)
+
+	// a later first seen time of another run does not matter
+	rememberFirstSeen([]byte(`{"address":"C4:7C:8D:66:D5:27","first_seen":"2020-04-03T10:00:00Z"}`))
+	sendInventory(send)
+	assert.Equal(t, time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC), receiveMetrics(send)[0].(mifloraInventoryMetric).firstSeen)
+}
+
+func TestSendInventoryOf(t *testing.T) {
+	now := time.Now()
+	allPeripherals = []*peripheral{
+		{id: "C4:7C:8D:66:D5:27", firstSeen: now, lastSeen: now},
+		{id: "C4:7C:8D:66:D5:28", firstSeen: now, lastSeen: now},
+	}
+	defer func() { allPeripherals = nil }()
+
+	// only the peripherals read on this wake
+	send := make(chan mifloraMetric, 10)
+	sendInventoryOf(send, allPeripherals[1:])
+	metrics := receiveMetrics(send)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "c47c8d66d528", metrics[0].getPeripheralId())
+
+	sendInventoryOf(send, nil)
+	assert.Empty(t, receiveMetrics(send))
+}
+
+func TestSendInventoryUnlocked(t *testing.T) {
+	allPeripherals = []*peripheral{{id: "C4:7C:8D:66:D5:27", firstSeen: time.Now(), lastSeen: time.Now()}}
+	defer func() { allPeripherals = nil }()
+
+	send := make(chan mifloraMetric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendInventory(send)
+	}()
+
+	// scanning goes on while the publisher is busy
+	time.Sleep(10 * time.Millisecond)
+	passiveLock.Lock()
+	passiveLock.Unlock()
+	<-send
+	<-done
+}
+
+func TestFormatInventory(t *testing.T) {
+	metric := mifloraInventoryMetric{
+		peripheralId: "c47c8d66d527",
+		address:      "C4:7C:8D:66:D5:27",
+		info:         common.SensorInfo{DeviceName: "Flower care", Appearance: 0, FirmwareVersion: "3.2.1"},
+		firstSeen:    time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC),
+		lastSeen:     time.Date(2020, 4, 2, 10, 0, 0, 0, time.UTC),
+	}
+
+	assert.Equal(t, mqttMessage{
+		topic: "miflorad/inventory/c47c8d66d527",
+		payload: `{"address":"C4:7C:8D:66:D5:27","device_name":"Flower care","appearance":0,"firmware_version":"3.2.1",` +
+			`"first_seen":"2020-04-01T10:00:00Z","last_seen":"2020-04-02T10:00:00Z","adapter":"gateway1"}`,
+		retained: true,
+	}, formatInventory(metric, "miflorad/inventory", "gateway1"))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	common "miflorad/common"
+
+	"github.com/pkg/errors"
+)
+
+// prints every sensor data notification of the connected peripheral to out and
+// sends it to send (if not nil) until the connection is closed
+func streamSensorData(peripheralID string, labels peripheralLabels, conn common.MifloraConn, metaData common.VersionBatteryResponse, out io.Writer, send chan mifloraMetric) error {
+	err := common.SubscribeSensorData(conn, metaData, func(sensorData common.SensorDataResponse, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse live data of peripheral %s, err: %s\n", peripheralID, err)
+			return
+		}
+
+		fmt.Fprintf(out, "%s temperature=%.1f brightness=%d moisture=%d conductivity=%d\n",
+			time.Now().Format(time.RFC3339), sensorData.Temperature, sensorData.Brightness, sensorData.Moisture, sensorData.Conductivity)
+
+		if send != nil {
+			send <- mifloraDataMetric{
+				peripheralId: common.MifloraGetAlphaNumericID(peripheralID),
+				labels:       labels,
+				metaData:     metaData,
+				sensorData:   sensorData,
+				rssi:         conn.RSSI(),
+			}
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't subscribe sensor data")
+	}
+
+	return nil
+}
+
+// waits until stopped by a signal or the connection is lost, returns whether it was lost
+func waitLiveStopped(conn common.MifloraConn, peripheralID string, signals chan os.Signal) bool {
+	select {
+	case signal := <-signals:
+		fmt.Fprintf(os.Stderr, "Received %s! Stopping...\n", signal)
+		return false
+	case <-conn.Disconnected():
+		fmt.Fprintf(os.Stderr, "Connection to peripheral %s lost! Stopping...\n", peripheralID)
+		return true
+	}
+}
+
+func runLive(args []string, cfg *config) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] live peripheral-id\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	// like the daemon closing send makes the formatter and publisher finish all metrics
+	var send chan mifloraMetric
+	var broker *brokerConnection
+	var wg sync.WaitGroup
+	if *livePublish {
+		format, err := parsePublishFormat(*publishFormatFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s! Exiting...\n", err)
+			os.Exit(1)
+		}
+		if format == homieFormat {
+			homie = newHomieDevice(*homieBaseTopic, getAdapterName())
+		}
+
+		broker, err = newBrokerConnection(false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect MQTT, err: %s\n", err)
+			os.Exit(1)
+		}
+
+		send = make(chan mifloraMetric, 1)
+		publish := make(chan metricLine, 10)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			formatMetrics(format, send, publish, nil)
+			close(publish)
+		}()
+		go func() {
+			defer wg.Done()
+			publishMetrics(broker, publish)
+		}()
+	}
+
+	backend, err := newBackend(*backendFlag, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open device, err: %s\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *scanTimeout)
+	defer cancel()
+	conn, err := backend.Connect(ctx, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to %s, err: %s\n", args[0], err)
+		os.Exit(1)
+	}
+
+	metaData, err := common.RequestVersionBattery(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to request version battery, err: %s\n", err)
+		conn.Close()
+		os.Exit(1)
+	}
+
+	var labels peripheralLabels
+	if sensor := cfg.findSensor(args[0]); sensor != nil {
+		labels = peripheralLabels{name: sensor.Name, room: sensor.Room, plant: sensor.Plant}
+	}
+
+	if err := streamSensorData(args[0], labels, conn, metaData, os.Stdout, send); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stream live data, err: %s\n", err)
+		conn.Close()
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Streaming live data of peripheral %s, press Ctrl-C to stop...\n", args[0])
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	lost := waitLiveStopped(conn, args[0], signals)
+	if !lost {
+		if err := conn.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to disconnect, err: %s\n", err)
+		}
+	}
+
+	// no more notifications are sent once disconnected
+	if send != nil {
+		close(send)
+		if !waitTimeout(&wg, *shutdownTimeout) {
+			fmt.Fprintf(os.Stderr, "Shutdown timeout of %s exceeded, dropping queued metrics\n", *shutdownTimeout)
+		}
+		broker.disconnect()
+	}
+
+	if err := backend.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to close device, err: %s\n", err)
+	}
+
+	if lost {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	common "miflorad/common"
+	sim "miflorad/common/sim"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamSensorData(t *testing.T) {
+	simPeripheral := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	simPeripheral.NotifyInterval = 5 * time.Millisecond
+	backend := sim.NewBackend(simPeripheral)
+
+	conn, err := backend.Connect(context.Background(), "C4:7C:8D:66:D5:27")
+	assert.NoError(t, err)
+
+	metaData := common.VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "2.7.0"}
+	out := &bytes.Buffer{}
+	send := make(chan mifloraMetric, 100)
+
+	assert.NoError(t, streamSensorData("C4:7C:8D:66:D5:27", peripheralLabels{}, conn, metaData, out, send))
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, conn.Close())
+
+	metrics := receiveMetrics(send)
+	assert.NotEmpty(t, metrics)
+	for _, metric := range metrics {
+		assert.Equal(t, mifloraDataMetric{
+			peripheralId: "c47c8d66d527",
+			metaData:     metaData,
+			sensorData:   simPeripheral.SensorData,
+			rssi:         -64,
+		}, metric)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, len(metrics))
+	assert.True(t, strings.HasSuffix(lines[0], " temperature=24.2 brightness=121 moisture=16 conductivity=101"))
+}
+
+func TestWaitLiveStopped(t *testing.T) {
+	simPeripheral := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	simPeripheral.NotifyInterval = 5 * time.Millisecond
+	simPeripheral.DisconnectAfter = 5
+	backend := sim.NewBackend(simPeripheral)
+
+	conn, err := backend.Connect(context.Background(), "C4:7C:8D:66:D5:27")
+	assert.NoError(t, err)
+
+	metaData := common.VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "2.7.0"}
+	send := make(chan mifloraMetric, 100)
+	assert.NoError(t, streamSensorData("C4:7C:8D:66:D5:27", peripheralLabels{}, conn, metaData, &bytes.Buffer{}, send))
+
+	// the device drops the connection
+	assert.True(t, waitLiveStopped(conn, "C4:7C:8D:66:D5:27", make(chan os.Signal)))
+	assert.NotEmpty(t, send)
+
+	conn, err = backend.Connect(context.Background(), "C4:7C:8D:66:D5:27")
+	assert.NoError(t, err)
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	assert.False(t, waitLiveStopped(conn, "C4:7C:8D:66:D5:27", signals))
+	assert.NoError(t, conn.Close())
+}
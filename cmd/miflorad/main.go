@@ -4,34 +4,86 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	common "miflorad/common"
-	impl "miflorad/common/ble"
+	bleimpl "miflorad/common/ble"
+	gattimpl "miflorad/common/gatt"
+	sim "miflorad/common/sim"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/go-ble/ble"
-	"github.com/go-ble/ble/examples/lib/dev"
 	"github.com/pkg/errors"
 )
 
-const mqttConnectTimeout = 10 * time.Second
+const (
+	mqttConnectTimeout = 10 * time.Second
+	// the device stores one history entry per hour
+	historyEntryInterval = 1 * time.Hour
+)
 
 var (
-	scanTimeout       = flag.Duration("scantimeout", 10*time.Second, "timeout after that a scan per peripheral will be aborted")
-	readRetries       = flag.Int("readretries", 2, "number of times reading will be attempted per peripheral")
-	interval          = flag.Duration("interval", 25*time.Second, "metrics collection interval")
-	brokerHost        = flag.String("brokerhost", "localhost", "MQTT broker host to send metrics to")
-	brokerUser        = flag.String("brokeruser", "", "MQTT broker user used for authentication")
-	brokerPassword    = flag.String("brokerpassword", "", "MQTT broker password used for authentication")
-	brokerUseTLS      = flag.Bool("brokerusetls", true, "whether TLS should be used for MQTT broker")
-	brokerTopicPrefix = flag.String("brokertopicprefix", "", "MQTT topic prefix for messages")
-	publishFormatFlag = flag.String("publishformat", "graphite", "MQTT message content format")
-	graphitePrefix    = flag.String("graphiteprefix", "", "Graphite metrics name prefix")
+	configFile          = flag.String("config", "", "YAML config file with sensors and settings, flags given on the command line take precedence")
+	scanTimeout         = flag.Duration("scantimeout", 10*time.Second, "timeout after that a scan per peripheral will be aborted")
+	readRetries         = flag.Int("readretries", 2, "number of times reading will be attempted per peripheral")
+	interval            = flag.Duration("interval", 25*time.Second, "metrics collection interval")
+	jitterFlag          = flag.Duration("jitter", 0, "maximum random delay of each reading within its interval for spreading readings")
+	brokerHost          = flag.String("brokerhost", "localhost", "MQTT broker host to send metrics to")
+	brokerUser          = flag.String("brokeruser", "", "MQTT broker user used for authentication")
+	brokerPassword      = flag.String("brokerpassword", "", "MQTT broker password used for authentication")
+	brokerUseTLS        = flag.Bool("brokerusetls", true, "whether TLS should be used for MQTT broker")
+	brokerCAFile        = flag.String("brokercafile", "", "PEM file with CA certificates for verifying the MQTT broker instead of the system ones")
+	brokerCertFile      = flag.String("brokercertfile", "", "PEM file with the client certificate for authenticating at the MQTT broker")
+	brokerKeyFile       = flag.String("brokerkeyfile", "", "PEM file with the private key of the client certificate")
+	brokerServerName    = flag.String("brokerservername", "", "server name expected in the MQTT broker certificate, defaults to the broker host")
+	brokerTLSMinVersion = flag.String("brokertlsminversion", "1.2", "minimum TLS version for the MQTT broker connection: 1.0, 1.1, 1.2 or 1.3")
+	brokerTopicPrefix   = flag.String("brokertopicprefix", "", "MQTT topic prefix for messages")
+	brokerPort          = flag.Int("brokerport", 0, "MQTT broker port, defaults to 8883 with TLS and 1883 without")
+	brokerURLFlag       = flag.String("brokerurl", "", "MQTT broker URL e.g. tcp://host:1883, ssl://host:8883 or wss://host/mqtt, overrides host, port and TLS usage")
+	brokerClientID      = flag.String("brokerclientid", "", "MQTT client ID, a stable one is needed e.g. for ACLs or persistent sessions")
+	brokerQoS           = flag.Int("brokerqos", 1, "MQTT quality of service used for publishing: 0, 1 or 2")
+	brokerRetain        = flag.Bool("brokerretain", false, "whether metrics are published as retained MQTT messages")
+	brokerKeepAlive     = flag.Duration("brokerkeepalive", 30*time.Second, "MQTT keepalive interval")
+	brokerCleanSession  = flag.Bool("brokercleansession", true, "whether the MQTT broker should discard the session on disconnect")
+	brokerConnectRetry  = flag.Bool("brokerconnectretry", false, "whether the initial MQTT connection is retried in the background instead of failing")
+	brokerRetryInterval = flag.Duration("brokerconnectretryinterval", 30*time.Second, "delay between initial MQTT connection attempts")
+	brokerAutoReconnect = flag.Bool("brokerautoreconnect", true, "whether a lost MQTT connection is re-established automatically")
+	brokerMaxReconnect  = flag.Duration("brokermaxreconnectinterval", 10*time.Minute, "maximum delay between MQTT reconnection attempts")
+	publishFormatFlag   = flag.String("publishformat", "graphite", "MQTT message content format: graphite, influx, topics (plain value per metric on its own topic), homie (Homie 4 convention) or json (a document per metric)")
+	topicTemplate       = flag.String("brokertopictemplate", "{prefix}/{sensor}/{metric}", "MQTT topic per metric for the topics publish format with placeholders {prefix}, {sensor} (ID), {name} (friendly name or ID), {room} and {metric}")
+	homieBaseTopic      = flag.String("homiebasetopic", "homie", "MQTT base topic of the homie publish format, the device ID is derived from the adapter name")
+	graphitePrefix      = flag.String("graphiteprefix", "", "Graphite metrics name prefix")
+	backendFlag         = flag.String("backend", "ble", "BLE library used for connecting to peripherals: ble (go-ble), gatt (currantlabs/gatt) or sim (simulated peripherals)")
+	modeFlag            = flag.String("mode", "active", "how sensor data is collected: active (connect to each peripheral) or passive (decode advertisements)")
+	bindKeysFlag        = flag.String("bindkeys", "", "comma separated list of peripheral-id=bind-key pairs for decrypting MiBeacon advertisements in passive mode")
+	backfillHistory     = flag.Bool("backfillhistory", false, "whether missed readings should be backfilled from the on-device history after an outage")
+	backfillMaxAge      = flag.Duration("backfillmaxage", 24*time.Hour, "maximum age of on-device history entries that will be backfilled")
+	availabilityTopic   = flag.String("brokeravailabilitytopic", "miflorad/availability", "MQTT topic for the retained online/offline state of miflorad (also used as Last Will except with the homie publish format) and prefix for the state per peripheral, disabled if empty")
+	offlineAfter        = flag.Int("offlineafter", 3, "number of consecutive failed reads after that a peripheral is reported offline")
+	homeAssistantPrefix = flag.String("homeassistantprefix", "", "Home Assistant MQTT discovery prefix e.g. homeassistant for publishing discovery configs and JSON states of all peripherals, disabled if empty")
+	inventoryTopic      = flag.String("brokerinventorytopic", "miflorad/inventory", "MQTT topic prefix for retained per peripheral inventory records")
+	adapterName         = flag.String("adapter", "", "BLE adapter name reported in inventory records, defaults to the host name")
+	shutdownTimeout     = flag.Duration("shutdowntimeout", 10*time.Second, "maximum time for publishing queued metrics on shutdown")
+	queueDir            = flag.String("queuedir", "", "directory of a persistent queue buffering lines while the MQTT broker is unreachable, disabled if empty (values of the topics and homie formats carry no timestamp and are dropped once older than the interval of their sensor)")
+	queueMaxSize        = flag.Int64("queuemaxsize", 16*1024*1024, "maximum size in bytes of the persistent queue, the oldest lines are dropped beyond")
+	queueMaxAge         = flag.Duration("queuemaxage", 7*24*time.Hour, "maximum age of lines in the persistent queue, older lines are dropped")
+	prometheusListen    = flag.String("prometheuslisten", "", "address e.g. :9521 to serve Prometheus metrics on /metrics from, disabled if empty")
+	prometheusStaleness = flag.Duration("prometheusstaleness", 10*time.Minute, "age after that readings are no longer served as Prometheus metrics")
+	influxURL           = flag.String("influxurl", "", "InfluxDB URL e.g. http://localhost:8086 to write Influx lines to directly, disabled if empty")
+	influxDatabase      = flag.String("influxdatabase", "", "InfluxDB database written to with the v1 API")
+	influxUser          = flag.String("influxuser", "", "InfluxDB user used for authentication with the v1 API")
+	influxPassword      = flag.String("influxpassword", "", "InfluxDB password used for authentication with the v1 API")
+	influxOrg           = flag.String("influxorg", "", "InfluxDB organization written to with the v2 API")
+	influxBucket        = flag.String("influxbucket", "", "InfluxDB bucket written to with the v2 API, the v1 API is used if empty")
+	influxToken         = flag.String("influxtoken", "", "InfluxDB API token used for authentication")
+	influxPrecision     = flag.String("influxprecision", "s", "timestamp precision of lines written to InfluxDB: ns, us, ms or s")
+	influxBatchSize     = flag.Int("influxbatchsize", 100, "maximum number of lines written to InfluxDB at once")
+	influxFlushInterval = flag.Duration("influxflushinterval", 10*time.Second, "maximum time lines are buffered before being written to InfluxDB")
+	influxGzip          = flag.Bool("influxgzip", true, "whether lines written to InfluxDB are gzip compressed")
+	livePublish         = flag.Bool("livepublish", false, "whether live mode also sends readings to the MQTT broker")
 )
 
 type publishFormat int
@@ -39,154 +91,383 @@ type publishFormat int
 const (
 	graphiteFormat publishFormat = iota
 	influxFormat   publishFormat = iota
+	topicsFormat   publishFormat = iota
+	homieFormat    publishFormat = iota
+	jsonFormat     publishFormat = iota
 )
 
 type peripheral struct {
 	id                string
 	lastMetaDataFetch time.Time
+	lastDataFetch     time.Time
 	metaData          common.VersionBatteryResponse
+	lastInfoFetch     time.Time
+	info              common.SensorInfo
+	firstSeen         time.Time
+	lastSeen          time.Time
+	// start of the current interval of the schedule and when it will be read within
+	slot    time.Time
+	nextDue time.Time
+	// reset on the first successful read
+	consecutiveFailures int
+	// from the config file
+	labels      peripheralLabels
+	interval    time.Duration
+	readRetries int
+	scanTimeout time.Duration
+	// only used in passive mode
+	bindKey       []byte
+	beaconState   common.MiBeaconSensorState
+	beaconUpdated bool
+	beaconRSSI    int
 }
 
 var allPeripherals []*peripheral
 
+type collectionMode int
+
+const (
+	activeMode  collectionMode = iota
+	passiveMode collectionMode = iota
+)
+
 type mifloraMetric interface {
 	getPeripheralId() string
+	getLabels() peripheralLabels
 }
 
 type mifloraDataMetric struct {
 	peripheralId string
+	labels       peripheralLabels
 	metaData     common.VersionBatteryResponse
 	sensorData   common.SensorDataResponse
 	connectTime  float64
 	readoutTime  float64
 	rssi         int
+	// of the peripheral, 0 if unknown (live mode)
+	interval time.Duration
 }
 
 func (m mifloraDataMetric) getPeripheralId() string {
 	return m.peripheralId
 }
 
-type mifloraErrorMetric struct {
+func (m mifloraDataMetric) getLabels() peripheralLabels {
+	return m.labels
+}
+
+type mifloraHistoryMetric struct {
 	peripheralId string
-	failed       int
+	labels       peripheralLabels
+	timestamp    time.Time
+	sensorData   common.SensorDataResponse
+}
+
+func (m mifloraHistoryMetric) getPeripheralId() string {
+	return m.peripheralId
+}
+
+func (m mifloraHistoryMetric) getLabels() peripheralLabels {
+	return m.labels
+}
+
+type mifloraErrorMetric struct {
+	peripheralId        string
+	labels              peripheralLabels
+	failed              int
+	reason              failureReason // empty when recovered
+	consecutiveFailures int
+	interval            time.Duration // of the peripheral
 }
 
 func (m mifloraErrorMetric) getPeripheralId() string {
 	return m.peripheralId
 }
 
-type mqttLogger struct {
-	level string
+func (m mifloraErrorMetric) getLabels() peripheralLabels {
+	return m.labels
+}
+
+// readings that were not taken since the previous ones took too long
+type mifloraSkippedMetric struct {
+	peripheralId string
+	labels       peripheralLabels
+	skipped      int
+	interval     time.Duration // of the peripheral
 }
 
-func (logger mqttLogger) Println(a ...interface{}) {
-	fmt.Fprintln(os.Stderr, fmt.Sprintf("mqtt %s:", logger.level), a)
+func (m mifloraSkippedMetric) getPeripheralId() string {
+	return m.peripheralId
 }
 
-func (logger mqttLogger) Printf(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, "mqtt %s: "+format, logger.level, a)
+func (m mifloraSkippedMetric) getLabels() peripheralLabels {
+	return m.labels
 }
 
+// the time until the next metric of the peripheral, values without timestamp are outdated after
+func readingInterval(metric mifloraMetric, fallback time.Duration) time.Duration {
+	interval := time.Duration(0)
+	switch metric := metric.(type) {
+	case mifloraDataMetric:
+		interval = metric.interval
+	case mifloraErrorMetric:
+		interval = metric.interval
+	case mifloraSkippedMetric:
+		interval = metric.interval
+	}
+	if interval == 0 {
+		return fallback
+	}
+	return interval
+}
+
+func newBackend(name string, peripheralIDs []string) (common.MifloraBackend, error) {
+	switch name {
+	case "ble":
+		return bleimpl.NewBackend()
+	case "gatt":
+		return gattimpl.NewBackend()
+	case "sim":
+		// simulates all given peripherals for running without hardware
+		simPeripherals := make([]*sim.Peripheral, len(peripheralIDs))
+		for i, peripheralID := range peripheralIDs {
+			simPeripherals[i] = &sim.Peripheral{
+				ID:              peripheralID,
+				FirmwareVersion: "3.2.1",
+				BatteryLevel:    100,
+				SensorData:      common.SensorDataResponse{Temperature: 21.5, Brightness: 1500, Moisture: 35, Conductivity: 420},
+				RSSI:            -60,
+				ConnectLatency:  500 * time.Millisecond,
+				Latency:         50 * time.Millisecond,
+			}
+		}
+		return sim.NewBackend(simPeripherals...), nil
+	default:
+		return nil, errors.Errorf("unrecognized backend %s", name)
+	}
+}
+
+// reading all peripherals one after another may take longer than an interval
+// which leads to skipped readings
 func checkTooShortInterval() error {
-	numPeripherals := int64(len(flag.Args()))
-	numReadRetries := int64(*readRetries)
-	if (*scanTimeout).Nanoseconds()*numReadRetries*numPeripherals >= (*interval).Nanoseconds() {
+	var worstCase time.Duration
+	for _, peripheral := range allPeripherals {
+		worstCase += peripheral.getScanTimeout() * time.Duration(peripheral.getReadRetries())
+	}
+	tooShort := 0
+	for _, peripheral := range allPeripherals {
+		if peripheral.getInterval() <= worstCase {
+			tooShort++
+		}
+	}
+	if tooShort > 0 {
 		return errors.Errorf(
-			"The interval of %s is too short given the scan timeout of %s "+
-				"for %d peripheral(s) with %d retries each! Exiting...\n",
-			*interval, *scanTimeout, numPeripherals, *readRetries)
+			"The interval of %d peripheral(s) is shorter than reading all %d peripheral(s) "+
+				"may take (up to %s), expect skipped readings",
+			tooShort, len(allPeripherals), worstCase)
 	}
 	return nil
 }
 
-func getMQTTOptions() *mqtt.ClientOptions {
-	if *brokerUseTLS {
-		return mqtt.NewClientOptions().
-			AddBroker(fmt.Sprintf("ssl://%s:8883", *brokerHost)).
-			SetUsername(*brokerUser).
-			SetPassword(*brokerPassword)
-	} else {
-		return mqtt.NewClientOptions().
-			AddBroker(fmt.Sprintf("tcp://%s:1883", *brokerHost)).
-			SetUsername(*brokerUser).
-			SetPassword(*brokerPassword)
+func parsePublishFormat(name string) (publishFormat, error) {
+	switch name {
+	case "graphite":
+		return graphiteFormat, nil
+	case "influx":
+		return influxFormat, nil
+	case "topics":
+		return topicsFormat, nil
+	case "homie":
+		return homieFormat, nil
+	case "json":
+		return jsonFormat, nil
+	default:
+		return 0, errors.Errorf("Unrecognized publish format %s", name)
 	}
 }
 
-func readData(peripheral *peripheral, client ble.Client) (common.SensorDataResponse, error) {
-	// re-request meta data (for battery level) if last check more than 24 hours ago
-	// Source: https://github.com/open-homeautomation/miflora/blob/ffd95c3e616df8843cc8bff99c9b60765b124092/miflora/miflora_poller.py#L92
-	if time.Since(peripheral.lastMetaDataFetch) >= 1*time.Hour {
-		metaData, err := impl.RequestVersionBattery(client)
-		if err != nil {
-			return common.SensorDataResponse{}, errors.Wrap(err, "can't request version battery")
+// a formatted line together with the peripheral it belongs to
+type metricLine struct {
+	peripheralId string
+	line         string
+	// the metrics topic is used if empty
+	topic string
+	// published retained regardless of the broker settings
+	retained bool
+	// lines without timestamp are outdated after that long and not published from the queue anymore, 0 means never
+	validFor time.Duration
+}
+
+// formats all metrics received from send until it is closed
+func formatMetrics(format publishFormat, send chan mifloraMetric, publish chan metricLine, messages chan mqttMessage) {
+	adapter := getAdapterName()
+	availability := newAvailabilityTracker()
+	homeAssistant := newHomeAssistantTracker()
+	for metric := range send {
+		settingsLock.RLock()
+		graphitePrefix, inventoryTopic := *graphitePrefix, *inventoryTopic
+		topicPrefix, topicTemplate := *brokerTopicPrefix, *topicTemplate
+		availabilityTopic, offlineAfter := *availabilityTopic, *offlineAfter
+		homeAssistantPrefix := *homeAssistantPrefix
+		validFor := readingInterval(metric, *interval)
+		settingsLock.RUnlock()
+
+		if metric, ok := metric.(mifloraInventoryMetric); ok {
+			messages <- formatInventory(metric, inventoryTopic, adapter)
+			continue
+		}
+
+		if exporter != nil {
+			exporter.record(metric, time.Now())
+		}
+		if influxSink != nil {
+			influxSink.add(metricLine{
+				peripheralId: metric.getPeripheralId(),
+				line:         formatInflux(metric, time.Now(), influxSink.precision),
+			})
+		}
+
+		// live mode publishes no messages
+		if messages != nil && availabilityTopic != "" {
+			if state, changed := availability.update(metric, offlineAfter); changed {
+				messages <- formatAvailability(metric.getPeripheralId(), state, availabilityTopic)
+			}
+		}
+		if messages != nil && homeAssistantPrefix != "" {
+			for _, message := range homeAssistant.format(metric, homeAssistantPrefix, availabilityTopic) {
+				messages <- message
+			}
+		}
+
+		lines := []string{}
+		switch format {
+		case graphiteFormat:
+			lines = formatGraphite(metric, graphitePrefix)
+		case influxFormat:
+			lines = append(lines, formatInflux(metric, time.Now(), time.Nanosecond))
+		case topicsFormat:
+			for _, line := range formatTopics(metric, topicTemplate, topicPrefix) {
+				line.validFor = validFor
+				publish <- line
+			}
+		case homieFormat:
+			// the device is described by the daemon only, live mode just updates the values
+			if messages != nil {
+				for _, message := range homie.describe(metric) {
+					messages <- message
+				}
+			}
+			for _, line := range formatHomie(metric, homie) {
+				line.validFor = validFor
+				publish <- line
+			}
+		case jsonFormat:
+			lines = append(lines, formatJSON(metric, time.Now()))
+		}
+		for _, line := range lines {
+			publish <- metricLine{peripheralId: metric.getPeripheralId(), line: line}
 		}
-		peripheral.metaData = metaData
-		peripheral.lastMetaDataFetch = time.Now()
 	}
+}
 
-	if peripheral.metaData.RequiresModeChangeBeforeRead() {
-		err2 := impl.RequestModeChange(client)
-		if err2 != nil {
-			return common.SensorDataResponse{}, errors.Wrap(err2, "can't request mode change")
+// publishes all lines received from publish until it is closed
+func publishMetrics(broker *brokerConnection, publish chan metricLine) {
+	for line := range publish {
+		// fmt.Fprintln(os.Stdout, line.line)
+		if err := broker.publishLine(line); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to publish MQTT, err: %s\n", err)
+			recordPublishFailure(line.peripheralId)
+			continue
 		}
 	}
+}
 
-	sensorData, err3 := impl.RequestSensorData(client)
-	if err3 != nil {
-		return common.SensorDataResponse{}, errors.Wrap(err3, "can't request sensor data")
+func readData(peripheral *peripheral, conn common.MifloraConn) (common.SensorDataResponse, error) {
+	// re-request meta data (for battery level) if last check more than 24 hours ago
+	// Source: https://github.com/open-homeautomation/miflora/blob/ffd95c3e616df8843cc8bff99c9b60765b124092/miflora/miflora_poller.py#L92
+	refreshMetaData := time.Since(peripheral.lastMetaDataFetch) >= 1*time.Hour
+
+	metaData, sensorData, err := common.ReadMiflora(conn, peripheral.metaData, refreshMetaData)
+	if refreshMetaData && metaData.FirmwareVersion != "" {
+		peripheral.metaData = metaData
+		peripheral.lastMetaDataFetch = time.Now()
+	}
+	if err != nil {
+		return common.SensorDataResponse{}, err
 	}
 
 	return sensorData, nil
 }
 
-func connectPeripheral(peripheral *peripheral, send chan mifloraMetric) error {
+// sends all history entries recorded after the given point in time (but not
+// older than the backfill max age) as metrics with their original timestamps
+func readHistory(peripheral *peripheral, conn common.MifloraConn, since time.Time, send chan mifloraMetric) error {
+	if oldest := time.Now().Add(-*backfillMaxAge); since.Before(oldest) {
+		since = oldest
+	}
+
+	deviceTime, err := common.RequestDeviceTime(conn)
+	if err != nil {
+		return errors.Wrap(err, "can't request device time")
+	}
 
-	// only way to get back the found advertisement, must be buffered!
-	foundAdvertisementChannel := make(chan ble.Advertisement, 1)
+	entries, err2 := common.RequestHistory(conn, deviceTime.DeviceTimeAt(since))
+	if err2 != nil {
+		return errors.Wrap(err2, "can't request history")
+	}
 
-	filter := func(adv ble.Advertisement) bool {
-		if strings.EqualFold(adv.Addr().String(), peripheral.id) {
-			foundAdvertisementChannel <- adv
-			return true
+	for _, entry := range entries {
+		timestamp := deviceTime.WallTime(entry.DeviceTime)
+		if !timestamp.After(since) || timestamp.After(deviceTime.ReadAt) {
+			continue
+		}
+		send <- mifloraHistoryMetric{
+			peripheralId: common.MifloraGetAlphaNumericID(peripheral.id),
+			labels:       peripheral.labels,
+			timestamp:    timestamp,
+			sensorData:   entry.SensorData(),
 		}
-		return false
 	}
 
+	return nil
+}
+
+func connectPeripheral(ctx context.Context, backend common.MifloraBackend, peripheral *peripheral, send chan mifloraMetric) error {
 	timeConnectStart := time.Now()
 
-	ctx := ble.WithSigHandler(context.WithTimeout(context.Background(), *scanTimeout))
-	client, err := ble.Connect(ctx, filter)
+	ctx, cancel := context.WithTimeout(ctx, peripheral.getScanTimeout())
+	defer cancel()
+	conn, err := backend.Connect(ctx, peripheral.id)
 	if err != nil {
 		return errors.Wrapf(err, "can't connect to %s", peripheral.id)
 	}
 
 	timeConnectTook := time.Since(timeConnectStart).Seconds()
 
-	// Source: https://github.com/go-ble/ble/blob/master/examples/basic/explorer/main.go#L53
-	// Make sure we had the chance to print out the message.
-	done := make(chan struct{})
-	// Normally, the connection is disconnected by us after our exploration.
-	// However, it can be asynchronously disconnected by the remote peripheral.
-	// So we wait(detect) the disconnection in the go routine.
-	go func() {
-		<-client.Disconnected()
-		close(done)
-	}()
-
 	timeReadoutStart := time.Now()
 
-	if _, err := client.DiscoverProfile(true); err != nil {
-		return errors.Wrap(err, "can't descover profile")
-	}
-
-	sensorData, err2 := readData(peripheral, client)
+	sensorData, err2 := readData(peripheral, conn)
 
 	timeReadoutTook := time.Since(timeReadoutStart).Seconds()
 
-	err3 := client.CancelConnection()
+	// backfill readings missed during an outage (e.g. of the gateway) from the on-device history
+	if err2 == nil && *backfillHistory && peripheral.metaData.HasCapability(common.CapabilityHistory) &&
+		time.Since(peripheral.lastDataFetch) >= historyEntryInterval {
+		if err := readHistory(peripheral, conn, peripheral.lastDataFetch, send); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to backfill history of peripheral %s, err: %s\n", peripheral.id, err)
+		}
+	}
+
+	if err2 == nil && time.Since(peripheral.lastInfoFetch) >= sensorInfoInterval {
+		if info, err := common.RequestSensorInfo(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read sensor info of peripheral %s, err: %s\n", peripheral.id, err)
+		} else {
+			peripheral.info = info
+			peripheral.lastInfoFetch = time.Now()
+		}
+	}
 
-	<-done
+	err3 := conn.Close()
 
 	if err2 != nil {
 		return errors.Wrap(err2, "can't read data")
@@ -196,163 +477,353 @@ func connectPeripheral(peripheral *peripheral, send chan mifloraMetric) error {
 		return errors.Wrap(err3, "can't disconnect after reading data")
 	}
 
+	peripheral.lastDataFetch = time.Now()
+	peripheral.markSeen(peripheral.lastDataFetch)
+
 	send <- mifloraDataMetric{
 		peripheralId: common.MifloraGetAlphaNumericID(peripheral.id),
+		labels:       peripheral.labels,
 		sensorData:   sensorData,
 		metaData:     peripheral.metaData,
 		connectTime:  timeConnectTook,
 		readoutTime:  timeReadoutTook,
-		rssi:         (<-foundAdvertisementChannel).RSSI(),
+		rssi:         conn.RSSI(),
+		interval:     peripheral.getInterval(),
 	}
 
 	return nil
 }
 
-func readPeripheral(quit chan struct{}, peripheral *peripheral, send chan mifloraMetric) error {
+func readPeripheral(ctx context.Context, backend common.MifloraBackend, peripheral *peripheral, send chan mifloraMetric) error {
 	var err error
 	fmt.Fprintf(os.Stderr, "Scanning for %s...", peripheral.id)
-L:
-	for retry := 0; retry < *readRetries; retry++ {
-		// check for quit signal (non-blocking) and terminate
-		select {
-		case <-quit:
-			break L
-		default:
+	for retry := 0; retry < peripheral.getReadRetries(); retry++ {
+		// terminate on shutdown
+		if ctx.Err() != nil {
+			break
 		}
 
 		fmt.Fprintf(os.Stderr, " %d", retry+1)
-		err = connectPeripheral(peripheral, send)
+		err = connectPeripheral(ctx, backend, peripheral, send)
 		// stop retrying once we have a success, last err will be returned (or nil)
 		if err == nil {
 			fmt.Fprintf(os.Stderr, ".")
-			break L
+			break
 		}
 	}
 	fmt.Fprintf(os.Stderr, "\n")
 	return err
 }
 
-func readAllPeripherals(quit chan struct{}, send chan mifloraMetric) {
+// reads all peripherals that are due in the order of their schedule, each at most once,
+// and returns the peripherals read
+func readDuePeripherals(ctx context.Context, backend common.MifloraBackend, send chan mifloraMetric) []*peripheral {
+	read := map[*peripheral]bool{}
+	readInOrder := []*peripheral{}
+	for {
+		if ctx.Err() != nil {
+			return readInOrder
+		}
+
+		now := time.Now()
+		peripheral := nextDuePeripheral(now, read)
+		if peripheral == nil {
+			return readInOrder
+		}
+		read[peripheral] = true
+		readInOrder = append(readInOrder, peripheral)
+
+		if skipped := peripheral.takeSkippedSlots(now); skipped > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped %d reading(s) of peripheral %s\n", skipped, peripheral.id)
+			peripheral.recordSkipped(send, skipped)
+		}
+		if peripheral.isScheduled() {
+			peripheral.schedule(peripheral.slot.Add(peripheral.getInterval()))
+		} else {
+			peripheral.schedule(now.Add(peripheral.getInterval()))
+		}
+
+		readPeripheralOnce(ctx, backend, peripheral, send)
+	}
+}
+
+// reads all peripherals regardless of their schedule
+func readAllPeripherals(ctx context.Context, backend common.MifloraBackend, send chan mifloraMetric) {
 	for _, peripheral := range allPeripherals {
-		err := readPeripheral(quit, peripheral, send)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to read peripheral %s, err: %s\n", peripheral.id, err)
-			// id := common.MifloraGetAlphaNumericID(peripheral.id)
-			// send <- fmt.Sprintf("%s.miflora.%s.failed 1 %d", *prefix, id, time.Now().Unix())
-			continue
+		if ctx.Err() != nil {
+			return
+		}
+		readPeripheralOnce(ctx, backend, peripheral, send)
+	}
+}
+
+func readPeripheralOnce(ctx context.Context, backend common.MifloraBackend, peripheral *peripheral, send chan mifloraMetric) {
+	// metrics of the previous cycle got lost
+	if takePublishFailures(common.MifloraGetAlphaNumericID(peripheral.id)) > 0 {
+		peripheral.recordFailure(send, failurePublish)
+	}
+
+	err := readPeripheral(ctx, backend, peripheral, send)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read peripheral %s, err: %s\n", peripheral.id, err)
+		// connections cancelled on shutdown are no failure of the peripheral
+		if ctx.Err() == nil {
+			peripheral.recordFailure(send, classifyFailure(err))
 		}
+		return
+	}
+	peripheral.recordSuccess(send)
+}
+
+// returns false if the wait group is not done within the timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
 }
 
 func main() {
 	flag.Parse()
-	if len(flag.Args()) < 1 {
+
+	given := commandLineFlags()
+	cfg := &config{}
+	if *configFile != "" {
+		var err error
+		cfg, err = loadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s! Exiting...\n", err)
+			os.Exit(1)
+		}
+		applyConfig(cfg, given)
+	}
+
+	if len(flag.Args()) < 1 && len(cfg.Sensors) < 1 {
 		fmt.Fprintf(os.Stderr,
-			"Usage: %s [options] peripheral-id [peripheral-ids...] \n", os.Args[0])
+			"Usage: %s [options] peripheral-id [peripheral-ids...] \n"+
+				"       %s [options] blink peripheral-id\n"+
+				"       %s [options] live peripheral-id\n", os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	if err := checkTooShortInterval(); err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(1)
+	switch flag.Arg(0) {
+	case "blink":
+		runBlink(flag.Args()[1:])
+		return
+	case "live":
+		runLive(flag.Args()[1:], cfg)
+		return
 	}
 
-	var format publishFormat
-	switch *publishFormatFlag {
-	case "graphite":
-		format = graphiteFormat
-	case "influx":
-		format = influxFormat
+	var mode collectionMode
+	switch *modeFlag {
+	case "active":
+		mode = activeMode
+	case "passive":
+		mode = passiveMode
 	default:
-		fmt.Fprintf(os.Stderr, "Unrecognized publish format %s! Exiting...\n",
-			*publishFormatFlag)
+		fmt.Fprintf(os.Stderr, "Unrecognized mode %s! Exiting...\n",
+			*modeFlag)
 		os.Exit(1)
 	}
 
-	fmt.Fprintf(os.Stderr, "miflorad version %s\n", getVersion())
+	// passive mode scans for advertisements via go-ble directly
+	if mode == passiveMode && *backendFlag != "ble" {
+		fmt.Fprintf(os.Stderr, "Passive mode requires the ble backend! Exiting...\n")
+		os.Exit(1)
+	}
 
-	mqtt.WARN = mqttLogger{level: "warning"}
-	mqtt.ERROR = mqttLogger{level: "error"}
-	mqtt.CRITICAL = mqttLogger{level: "critical"}
+	bindKeys, err := parseBindKeys(*bindKeysFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s! Exiting...\n", err)
+		os.Exit(1)
+	}
 
-	mqttClient := mqtt.NewClient(getMQTTOptions())
+	// populate all peripherals data structure
+	allPeripherals = newPeripherals(cfg, flag.Args(), bindKeys)
 
-	if token := mqttClient.Connect(); token.WaitTimeout(mqttConnectTimeout) && token.Error() != nil {
-		fmt.Fprintf(os.Stderr, "Failed to connect MQTT, err: %s\n", token.Error())
+	if mode == activeMode {
+		if err := checkTooShortInterval(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+		}
+	}
+
+	format, err := parsePublishFormat(*publishFormatFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s! Exiting...\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "miflorad version %s\n", getVersion())
+
+	if format == homieFormat {
+		homie = newHomieDevice(*homieBaseTopic, getAdapterName())
+	}
+
+	broker, err := newBrokerConnection(true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect MQTT, err: %s\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Fprintf(os.Stderr, "Connected to MQTT broker %s\n", *brokerHost)
+	peripheralIDs := make([]string, len(allPeripherals))
+	for i, peripheral := range allPeripherals {
+		peripheralIDs[i] = peripheral.id
+	}
 
-	device, err := dev.NewDevice("default")
+	backend, err := newBackend(*backendFlag, peripheralIDs)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to open device, err: %s\n", err)
 		os.Exit(1)
 	}
-	ble.SetDefaultDevice(device)
 
-	intervalTicker := time.NewTicker(*interval)
-	quit := make(chan struct{})
+	var metricsServer *http.Server
+	if *prometheusListen != "" {
+		exporter = newPrometheusExporter()
+		metricsServer, err = serveMetrics(*prometheusListen, exporter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start metrics server, err: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *influxURL != "" {
+		influxSink, err = newInfluxWriter(currentInfluxSettings())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s! Exiting...\n", err)
+			os.Exit(1)
+		}
+		go influxSink.run()
+	}
+
+	var queue *diskQueue
+	if *queueDir != "" {
+		queue, err = openDiskQueue(*queueDir, *queueMaxSize, *queueMaxAge)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open queue, err: %s\n", err)
+			os.Exit(1)
+		}
+		if length := queue.length(); length > 0 {
+			fmt.Fprintf(os.Stderr, "Replaying %d bytes of queued lines\n", length)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	send := make(chan mifloraMetric, 1)
-	publish := make(chan string, 10)
+	publish := make(chan metricLine, 10)
+	messages := make(chan mqttMessage, 10)
+	reloader := &reloader{
+		requests: make(chan *config, 1),
+		given:    given,
+		bindKeys: bindKeys,
+		broker:   broker,
+	}
+
+	// the collecting goroutine closes send once cancelled which in turn
+	// makes the formatter and the publishers finish all queued metrics,
+	// lines that can't be published then are kept in the persistent queue
+	var wg sync.WaitGroup
+	wg.Add(4)
 
 	go func() {
-		fmt.Fprintf(os.Stderr, "Starting loop with %s interval...\n", *interval)
-
-		// populate all peripherals data structure
-		allPeripherals = make([]*peripheral, len(flag.Args()))
-		for i, peripheralID := range flag.Args() {
-			allPeripherals[i] = &peripheral{
-				id:                peripheralID,
-				lastMetaDataFetch: time.Unix(0, 0), // force immediate 1st request
-			}
+		defer wg.Done()
+		defer close(send)
+
+		if mode == passiveMode {
+			fmt.Fprintf(os.Stderr, "Starting loop with %s interval...\n", *interval)
+			runPassive(ctx, backend, send, reloader)
+			return
 		}
 
 		// main loop
-		readAllPeripherals(quit, send)
-		for range intervalTicker.C {
-			readAllPeripherals(quit, send)
+		fmt.Fprintf(os.Stderr, "Starting loop for %d peripheral(s)...\n", len(allPeripherals))
+		for {
+			// each wake reads only a few peripherals due to their slots
+			sendInventoryOf(send, readDuePeripherals(ctx, backend, send))
+
+			timer := time.NewTimer(time.Until(nextDueTime(time.Now())))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			case cfg := <-reloader.requests:
+				timer.Stop()
+				reloader.apply(cfg)
+			}
 		}
 	}()
 
 	go func() {
-		switch format {
-		case graphiteFormat:
-			for metric := range send {
-				publishGraphite(metric, publish, *graphitePrefix)
-			}
-		case influxFormat:
-			for metric := range send {
-				publishInflux(metric, publish)
-			}
-		}
+		defer wg.Done()
+		formatMetrics(format, send, publish, messages)
+		close(publish)
+		close(messages)
 	}()
 
+	if queue != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spoolMetrics(queue, publish)
+		}()
+		go func() {
+			defer wg.Done()
+			forwardQueue(queue, func(line metricLine) error {
+				return broker.publishLine(line)
+			})
+		}()
+	} else {
+		go func() {
+			defer wg.Done()
+			publishMetrics(broker, publish)
+		}()
+	}
+
 	go func() {
-		for line := range publish {
-			// fmt.Fprintln(os.Stdout, line)
-			token := mqttClient.Publish(*brokerTopicPrefix, 1, false, line)
-			if token.WaitTimeout(1*time.Second) && token.Error() != nil {
-				fmt.Fprintf(os.Stderr, "Failed to publish MQTT, err: %s\n", token.Error())
-				continue
-			}
-		}
+		defer wg.Done()
+		publishMessages(broker, messages)
 	}()
 
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			fmt.Fprintf(os.Stderr, "Received %s! Stopping...\n", sig)
+			break
+		}
+		requestReload(reloader)
+	}
+	cancel()
+
+	if !waitTimeout(&wg, *shutdownTimeout) {
+		fmt.Fprintf(os.Stderr, "Shutdown timeout of %s exceeded, dropping queued metrics\n", *shutdownTimeout)
+	}
 
-	signal := <-signals
-	fmt.Fprintf(os.Stderr, "Received %s! Stopping...\n", signal)
-	intervalTicker.Stop()
-	close(quit)
-	// wait for last connectPeripheral to finish (worst case)
-	time.Sleep(*scanTimeout)
+	// the formatter is done, remaining lines are written once more
+	if influxSink != nil {
+		influxSink.close()
+	}
 
-	mqttClient.Disconnect(1000)
+	broker.disconnect()
+	if queue != nil {
+		queue.closeFiles()
+	}
+	if metricsServer != nil {
+		stopServingMetrics(metricsServer)
+	}
 
-	if err := device.Stop(); err != nil {
+	if err := backend.Stop(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to close device, err: %s\n", err)
 		os.Exit(1)
 	}
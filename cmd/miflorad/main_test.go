@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	common "miflorad/common"
+	sim "miflorad/common/sim"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSimPeripheral(id string) *sim.Peripheral {
+	return &sim.Peripheral{
+		ID:              id,
+		FirmwareVersion: "2.7.0",
+		BatteryLevel:    99,
+		SensorData:      common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		RSSI:            -64,
+	}
+}
+
+func setTestPeripherals(ids ...string) {
+	allPeripherals = make([]*peripheral, len(ids))
+	for i, id := range ids {
+		allPeripherals[i] = &peripheral{
+			id:                id,
+			lastMetaDataFetch: time.Unix(0, 0),
+		}
+	}
+}
+
+func receiveMetrics(send chan mifloraMetric) []mifloraMetric {
+	metrics := []mifloraMetric{}
+	for {
+		select {
+		case metric := <-send:
+			metrics = append(metrics, metric)
+		default:
+			return metrics
+		}
+	}
+}
+
+func TestReadAllPeripherals(t *testing.T) {
+	simPeripheral := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	backend := sim.NewBackend(simPeripheral)
+	setTestPeripherals("C4:7C:8D:66:D5:27")
+	defer func() { allPeripherals = nil }()
+
+	ctx := context.Background()
+	send := make(chan mifloraMetric, 10)
+
+	readAllPeripherals(ctx, backend, send)
+
+	metrics := receiveMetrics(send)
+	assert.Len(t, metrics, 1)
+	metric := metrics[0].(mifloraDataMetric)
+	assert.Equal(t, "c47c8d66d527", metric.peripheralId)
+	assert.Equal(t, common.VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "2.7.0"}, metric.metaData)
+	assert.Equal(t, simPeripheral.SensorData, metric.sensorData)
+	assert.Equal(t, -64, metric.rssi)
+	assert.Equal(t, common.SensorInfo{DeviceName: "Flower care", FirmwareVersion: "2.7.0"}, allPeripherals[0].info)
+	assert.False(t, allPeripherals[0].firstSeen.IsZero())
+	firstSeen := allPeripherals[0].firstSeen
+
+	// meta data is only refreshed after one hour
+	backend.Update(func() {
+		simPeripheral.BatteryLevel = 42
+		simPeripheral.SensorData.Moisture = 17
+	})
+	readAllPeripherals(ctx, backend, send)
+
+	metrics = receiveMetrics(send)
+	assert.Len(t, metrics, 1)
+	metric = metrics[0].(mifloraDataMetric)
+	assert.Equal(t, uint8(99), metric.metaData.BatteryLevel)
+	assert.Equal(t, uint8(17), metric.sensorData.Moisture)
+	assert.Equal(t, firstSeen, allPeripherals[0].firstSeen)
+	assert.True(t, allPeripherals[0].lastSeen.After(firstSeen))
+
+	allPeripherals[0].lastMetaDataFetch = time.Now().Add(-2 * time.Hour)
+	readAllPeripherals(ctx, backend, send)
+
+	metrics = receiveMetrics(send)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, uint8(42), metrics[0].(mifloraDataMetric).metaData.BatteryLevel)
+	assert.Equal(t, 3, simPeripheral.Connects)
+}
+
+func TestReadPeripheralRetries(t *testing.T) {
+	simPeripheral := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	backend := sim.NewBackend(simPeripheral)
+	setTestPeripherals("C4:7C:8D:66:D5:27")
+	defer func() { allPeripherals = nil }()
+
+	ctx := context.Background()
+	send := make(chan mifloraMetric, 10)
+
+	simPeripheral.FailConnects = *readRetries - 1
+	assert.NoError(t, readPeripheral(ctx, backend, allPeripherals[0], send))
+	assert.Len(t, receiveMetrics(send), 1)
+
+	simPeripheral.FailConnects = *readRetries
+	assert.Error(t, readPeripheral(ctx, backend, allPeripherals[0], send))
+	assert.Len(t, receiveMetrics(send), 0)
+
+	// connection dropped by device while reading
+	simPeripheral.DisconnectAfter = 1
+	assert.Error(t, readPeripheral(ctx, backend, allPeripherals[0], send))
+	assert.Len(t, receiveMetrics(send), 0)
+
+	// placeholder instead of sensor data
+	simPeripheral.DisconnectAfter = 0
+	simPeripheral.AlwaysPlaceholder = true
+	err := readPeripheral(ctx, backend, allPeripherals[0], send)
+	assert.Equal(t, common.ErrPlaceholderData, errors.Cause(err))
+	assert.Len(t, receiveMetrics(send), 0)
+}
+
+func TestReadHistoryBackfill(t *testing.T) {
+	simPeripheral := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	simPeripheral.DeviceTime = 4 * 3600
+	simPeripheral.History = []common.HistoryEntryResponse{
+		{DeviceTime: 1 * 3600, Temperature: 20.0},
+		{DeviceTime: 2 * 3600, Temperature: 21.0},
+		{DeviceTime: 3 * 3600, Temperature: 22.0},
+	}
+	backend := sim.NewBackend(simPeripheral)
+	setTestPeripherals("C4:7C:8D:66:D5:27")
+	defer func() { allPeripherals = nil }()
+
+	*backfillHistory = true
+	defer func() { *backfillHistory = false }()
+
+	// last successful read happened 150 minutes ago, so the last two entries are missing
+	allPeripherals[0].lastDataFetch = time.Now().Add(-150 * time.Minute)
+
+	ctx := context.Background()
+	send := make(chan mifloraMetric, 10)
+	readAllPeripherals(ctx, backend, send)
+
+	metrics := receiveMetrics(send)
+	assert.Len(t, metrics, 3)
+	assert.Equal(t, 21.0, metrics[0].(mifloraHistoryMetric).sensorData.Temperature)
+	assert.Equal(t, 22.0, metrics[1].(mifloraHistoryMetric).sensorData.Temperature)
+	assert.IsType(t, mifloraDataMetric{}, metrics[2])
+	// reading stops at the first entry that is not missing
+	assert.Equal(t, 3, simPeripheral.HistoryReads)
+}
+
+func TestPublishCycle(t *testing.T) {
+	backend := sim.NewBackend(newTestSimPeripheral("C4:7C:8D:66:D5:27"), newTestSimPeripheral("C4:7C:8D:66:D5:28"))
+	setTestPeripherals("C4:7C:8D:66:D5:27", "C4:7C:8D:66:D5:28")
+	defer func() { allPeripherals = nil }()
+
+	ctx := context.Background()
+	send := make(chan mifloraMetric, 10)
+
+	readAllPeripherals(ctx, backend, send)
+	close(send)
+	lines := []string{}
+	for metric := range send {
+		lines = append(lines, formatGraphite(metric, "foo.base")...)
+	}
+	assert.Len(t, lines, 2*9)
+	assert.True(t, strings.HasPrefix(lines[0], "foo.base.miflora.c47c8d66d527."))
+	assert.True(t, strings.HasPrefix(lines[9], "foo.base.miflora.c47c8d66d528."))
+}
+
+func TestFormatMetricsValidity(t *testing.T) {
+	defer takePublishFailures("peri")
+
+	send := make(chan mifloraMetric, 10)
+	publish := make(chan metricLine, 100)
+
+	// the sensor is read less often than the global interval
+	send <- mifloraDataMetric{peripheralId: "peri", interval: 10 * time.Minute}
+	send <- mifloraErrorMetric{peripheralId: "peri", failed: 1}
+	close(send)
+	formatMetrics(topicsFormat, send, publish, nil)
+	close(publish)
+
+	lines := []metricLine{}
+	for line := range publish {
+		lines = append(lines, line)
+	}
+	assert.Len(t, lines, 8+2)
+	assert.Equal(t, 10*time.Minute, lines[0].validFor)
+	assert.Equal(t, *interval, lines[8].validFor)
+
+	// still published after more than the global interval
+	queue, err := openDiskQueue(t.TempDir(), 0, 0)
+	assert.NoError(t, err)
+	defer queue.closeFiles()
+	now := time.Now()
+	queue.now = func() time.Time { return now }
+	assert.NoError(t, queue.push(lines[0]))
+	now = now.Add(1 * time.Minute)
+	entry, _, ok := queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, lines[0].line, entry.Line)
+
+	now = now.Add(10 * time.Minute)
+	queue.close()
+	_, _, ok = queue.peek()
+	assert.False(t, ok)
+	assert.Equal(t, 1, takePublishFailures("peri"))
+}
+
+func TestReadAllPeripheralsCancelled(t *testing.T) {
+	simPeripheral := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	simPeripheral.ConnectLatency = 10 * time.Second
+	backend := sim.NewBackend(simPeripheral)
+	setTestPeripherals("C4:7C:8D:66:D5:27", "C4:7C:8D:66:D5:28")
+	defer func() { allPeripherals = nil }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	send := make(chan mifloraMetric, 10)
+
+	// in-flight connection is cancelled
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	readAllPeripherals(ctx, backend, send)
+
+	assert.True(t, time.Since(start) < 1*time.Second)
+	assert.Empty(t, receiveMetrics(send))
+	assert.Equal(t, 0, allPeripherals[0].consecutiveFailures)
+	assert.Equal(t, 0, simPeripheral.Connects)
+}
+
+func TestWaitTimeout(t *testing.T) {
+	var wg sync.WaitGroup
+	assert.True(t, waitTimeout(&wg, 10*time.Millisecond))
+
+	wg.Add(1)
+	assert.False(t, waitTimeout(&wg, 10*time.Millisecond))
+	wg.Done()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	common "miflorad/common"
+
+	"github.com/go-ble/ble"
+	"github.com/pkg/errors"
+)
+
+// guards the state of all peripherals which is updated by the scan handler in passive mode
+var passiveLock sync.Mutex
+
+var miBeaconServiceUUID = ble.UUID16(common.MiBeaconServiceUUID16)
+
+func findPeripheral(address string) *peripheral {
+	for _, peripheral := range allPeripherals {
+		if strings.EqualFold(address, peripheral.id) {
+			return peripheral
+		}
+	}
+	return nil
+}
+
+// parses "peripheral-id=bind-key,..." into bind keys by (lower case) peripheral ID
+func parseBindKeys(s string) (map[string][]byte, error) {
+	bindKeys := make(map[string][]byte)
+	if s == "" {
+		return bindKeys, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid bind key pair %q, must be peripheral-id=bind-key", pair)
+		}
+		bindKey, err := common.ParseMiBeaconBindKey(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't parse bind key of %s", parts[0])
+		}
+		bindKeys[strings.ToLower(parts[0])] = bindKey
+	}
+	return bindKeys, nil
+}
+
+func handleAdvertisement(adv ble.Advertisement) {
+	passiveLock.Lock()
+	peripheral := findPeripheral(adv.Addr().String())
+	passiveLock.Unlock()
+	if peripheral == nil {
+		return
+	}
+
+	for _, serviceData := range adv.ServiceData() {
+		if !serviceData.UUID.Equal(miBeaconServiceUUID) {
+			continue
+		}
+
+		miBeacon, err := common.ParseMiBeaconWithKey(serviceData.Data, adv.Addr().String(), peripheral.bindKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse MiBeacon of peripheral %s, err: %s\n", peripheral.id, err)
+			continue
+		}
+
+		passiveLock.Lock()
+		for _, object := range miBeacon.Objects {
+			if err := peripheral.beaconState.Update(object); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to decode MiBeacon object of peripheral %s, err: %s\n", peripheral.id, err)
+				continue
+			}
+			peripheral.beaconUpdated = true
+		}
+		peripheral.beaconRSSI = adv.RSSI()
+		peripheral.markSeen(time.Now())
+		passiveLock.Unlock()
+	}
+}
+
+// scans for advertisements for the given duration or until cancelled
+func scanAdvertisements(ctx context.Context, duration time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	err := ble.Scan(ctx, true, handleAdvertisement, nil)
+	if err != nil && errors.Cause(err) != context.DeadlineExceeded && errors.Cause(err) != context.Canceled {
+		fmt.Fprintf(os.Stderr, "Failed to scan for advertisements, err: %s\n", err)
+	}
+}
+
+// sends metrics for all peripherals which broadcast new sensor data since the last call
+func sendPassiveMetrics(send chan mifloraMetric) {
+	passiveLock.Lock()
+	defer passiveLock.Unlock()
+
+	for _, peripheral := range allPeripherals {
+		if !peripheral.beaconUpdated || !peripheral.beaconState.HasSensorData() {
+			continue
+		}
+		peripheral.beaconUpdated = false
+
+		metaData := peripheral.metaData
+		if peripheral.beaconState.HasBattery() {
+			metaData.BatteryLevel = peripheral.beaconState.BatteryLevel
+		}
+
+		send <- mifloraDataMetric{
+			peripheralId: common.MifloraGetAlphaNumericID(peripheral.id),
+			labels:       peripheral.labels,
+			sensorData:   peripheral.beaconState.SensorData,
+			metaData:     metaData,
+			rssi:         peripheral.beaconRSSI,
+			interval:     peripheral.getInterval(),
+		}
+	}
+}
+
+// advertisements carry no firmware version (and not always the battery level)
+// so fall back to a GATT connection for the meta data
+func readMetaData(ctx context.Context, backend common.MifloraBackend, peripheral *peripheral) error {
+	ctx, cancel := context.WithTimeout(ctx, peripheral.getScanTimeout())
+	defer cancel()
+	conn, err := backend.Connect(ctx, peripheral.id)
+	if err != nil {
+		return errors.Wrapf(err, "can't connect to %s", peripheral.id)
+	}
+
+	metaData, err2 := common.RequestVersionBattery(conn)
+
+	var info common.SensorInfo
+	var err4 error
+	if err2 == nil {
+		info, err4 = common.RequestSensorInfo(conn)
+	}
+
+	err3 := conn.Close()
+
+	if err2 != nil {
+		return errors.Wrap(err2, "can't request version battery")
+	}
+
+	if err4 != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read sensor info of peripheral %s, err: %s\n", peripheral.id, err4)
+	}
+
+	if err3 != nil {
+		return errors.Wrap(err3, "can't disconnect after reading meta data")
+	}
+
+	passiveLock.Lock()
+	if peripheral.bindKey == nil && metaData.HasCapability(common.CapabilityEncryptedBeacons) {
+		fmt.Fprintf(os.Stderr, "Peripheral %s with firmware %s may send encrypted advertisements, consider configuring a bind key\n", peripheral.id, metaData.FirmwareVersion)
+	}
+	peripheral.metaData = metaData
+	peripheral.lastMetaDataFetch = time.Now()
+	if err4 == nil {
+		peripheral.info = info
+		peripheral.lastInfoFetch = peripheral.lastMetaDataFetch
+	}
+	passiveLock.Unlock()
+
+	return nil
+}
+
+func readAllMetaData(ctx context.Context, backend common.MifloraBackend) {
+	for _, peripheral := range allPeripherals {
+		if time.Since(peripheral.lastMetaDataFetch) < 24*time.Hour {
+			continue
+		}
+
+		// terminate on shutdown
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := readMetaData(ctx, backend, peripheral); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read meta data of peripheral %s, err: %s\n", peripheral.id, err)
+		}
+	}
+}
+
+func runPassive(ctx context.Context, backend common.MifloraBackend, send chan mifloraMetric, reloader *reloader) {
+	for {
+		select {
+		case cfg := <-reloader.requests:
+			reloader.apply(cfg)
+		default:
+		}
+
+		readAllMetaData(ctx, backend)
+		scanAdvertisements(ctx, *interval)
+		sendPassiveMetrics(send)
+		sendInventory(send)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	common "miflorad/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendPassiveMetrics(t *testing.T) {
+	complete := &peripheral{
+		id:       "C4:7C:8D:66:D5:27",
+		metaData: common.VersionBatteryResponse{BatteryLevel: 100, FirmwareVersion: "3.2.1"},
+		beaconState: common.MiBeaconSensorState{
+			SensorData:   common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+			BatteryLevel: 95,
+			Received:     common.MiBeaconHasSensorData | common.MiBeaconHasBattery,
+		},
+		beaconUpdated: true,
+		beaconRSSI:    -70,
+		interval:      10 * time.Minute,
+	}
+	incomplete := &peripheral{
+		id: "C4:7C:8D:66:D5:28",
+		beaconState: common.MiBeaconSensorState{
+			Received: common.MiBeaconHasTemperature,
+		},
+		beaconUpdated: true,
+	}
+	allPeripherals = []*peripheral{complete, incomplete}
+	defer func() { allPeripherals = nil }()
+
+	send := make(chan mifloraMetric, 10)
+	sendPassiveMetrics(send)
+	sendPassiveMetrics(send)
+	close(send)
+
+	metrics := []mifloraMetric{}
+	for metric := range send {
+		metrics = append(metrics, metric)
+	}
+
+	assert.Equal(t, []mifloraMetric{mifloraDataMetric{
+		peripheralId: "c47c8d66d527",
+		metaData:     common.VersionBatteryResponse{BatteryLevel: 95, FirmwareVersion: "3.2.1"},
+		sensorData:   common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		rssi:         -70,
+		interval:     10 * time.Minute,
+	}}, metrics)
+}
+
+func TestParseBindKeys(t *testing.T) {
+	bindKeys, err := parseBindKeys("")
+	assert.NoError(t, err)
+	assert.Empty(t, bindKeys)
+
+	bindKeys, err = parseBindKeys("C4:7C:8D:66:D5:27=b853075158487ca39a5b5ea9d5b8ef4c,c4:7c:8d:66:d5:28=00112233445566778899aabbccddeeff")
+	assert.NoError(t, err)
+	assert.Len(t, bindKeys, 2)
+	assert.Equal(t, []byte{0xb8, 0x53, 0x07, 0x51, 0x58, 0x48, 0x7c, 0xa3, 0x9a, 0x5b, 0x5e, 0xa9, 0xd5, 0xb8, 0xef, 0x4c}, bindKeys["c4:7c:8d:66:d5:27"])
+	assert.Contains(t, bindKeys, "c4:7c:8d:66:d5:28")
+
+	_, err = parseBindKeys("C4:7C:8D:66:D5:27")
+	assert.Error(t, err)
+	_, err = parseBindKeys("C4:7C:8D:66:D5:27=b853")
+	assert.Error(t, err)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// upper bounds in seconds of the connect and readout time histograms
+var prometheusDurationBuckets = []float64{0.25, 0.5, 1, 2.5, 5, 10, 25, 60}
+
+type prometheusHistogram struct {
+	// not cumulative, the last one counts observations above all buckets
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newPrometheusHistogram() *prometheusHistogram {
+	return &prometheusHistogram{counts: make([]uint64, len(prometheusDurationBuckets)+1)}
+}
+
+func (h *prometheusHistogram) observe(value float64) {
+	i := sort.SearchFloat64s(prometheusDurationBuckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// everything known about a peripheral from the metrics passing the formatter
+type prometheusSensor struct {
+	labels      peripheralLabels
+	lastData    mifloraDataMetric
+	lastSuccess time.Time
+	failures    map[failureReason]int
+	skipped     int
+	connectTime *prometheusHistogram
+	readoutTime *prometheusHistogram
+}
+
+// Serves the latest reading per peripheral in the Prometheus text exposition format,
+// readings older than the staleness window are left out while counters are kept.
+type prometheusExporter struct {
+	lock    sync.Mutex
+	sensors map[string]*prometheusSensor
+}
+
+// only set if the Prometheus exporter is enabled, the listen address can't be changed on reload
+var exporter *prometheusExporter
+
+func newPrometheusExporter() *prometheusExporter {
+	return &prometheusExporter{sensors: map[string]*prometheusSensor{}}
+}
+
+func (e *prometheusExporter) record(metric mifloraMetric, now time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	sensor, ok := e.sensors[metric.getPeripheralId()]
+	if !ok {
+		sensor = &prometheusSensor{
+			failures:    map[failureReason]int{},
+			connectTime: newPrometheusHistogram(),
+			readoutTime: newPrometheusHistogram(),
+		}
+		e.sensors[metric.getPeripheralId()] = sensor
+	}
+	sensor.labels = metric.getLabels()
+
+	switch metric := metric.(type) {
+	case mifloraDataMetric:
+		sensor.lastData = metric
+		sensor.lastSuccess = now
+		// passive mode involves no connection
+		if metric.connectTime > 0 {
+			sensor.connectTime.observe(metric.connectTime)
+			sensor.readoutTime.observe(metric.readoutTime)
+		}
+	case mifloraErrorMetric:
+		if metric.failed > 0 {
+			sensor.failures[metric.reason] += metric.failed
+		}
+	case mifloraSkippedMetric:
+		sensor.skipped += metric.skipped
+	}
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// the label set of a peripheral e.g. `sensor="c47c8d66d527",name="ficus"` followed by the extra labels
+func prometheusLabels(peripheralId string, labels peripheralLabels, extra ...string) string {
+	pairs := []string{"sensor", peripheralId, "name", labels.name, "room", labels.room, "plant", labels.plant}
+	pairs = append(pairs, extra...)
+
+	parts := []string{}
+	for i := 0; i < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], prometheusLabelEscaper.Replace(pairs[i+1])))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatPrometheusValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writes all metrics, families are written as a whole as required by the format
+func (e *prometheusExporter) write(w io.Writer, now time.Time, staleness time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	ids := make([]string, 0, len(e.sensors))
+	for id := range e.sensors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	family := func(name string, kind string, help string, samples func(id string, sensor *prometheusSensor)) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, id := range ids {
+			samples(id, e.sensors[id])
+		}
+	}
+	fresh := func(sensor *prometheusSensor) bool {
+		return !sensor.lastSuccess.IsZero() && (staleness <= 0 || now.Sub(sensor.lastSuccess) <= staleness)
+	}
+	gauge := func(name string, help string, value func(metric mifloraDataMetric) float64) {
+		family(name, "gauge", help, func(id string, sensor *prometheusSensor) {
+			if fresh(sensor) {
+				fmt.Fprintf(w, "%s{%s} %s\n", name, prometheusLabels(id, sensor.labels), formatPrometheusValue(value(sensor.lastData)))
+			}
+		})
+	}
+
+	gauge("miflora_temperature_celsius", "Temperature of the latest reading.", func(m mifloraDataMetric) float64 {
+		return m.sensorData.Temperature
+	})
+	gauge("miflora_moisture_percent", "Soil moisture of the latest reading.", func(m mifloraDataMetric) float64 {
+		return float64(m.sensorData.Moisture)
+	})
+	gauge("miflora_brightness_lux", "Brightness of the latest reading.", func(m mifloraDataMetric) float64 {
+		return float64(m.sensorData.Brightness)
+	})
+	gauge("miflora_conductivity_microsiemens_per_centimeter", "Soil conductivity of the latest reading.", func(m mifloraDataMetric) float64 {
+		return float64(m.sensorData.Conductivity)
+	})
+	gauge("miflora_battery_level_percent", "Battery level of the latest reading.", func(m mifloraDataMetric) float64 {
+		return float64(m.metaData.BatteryLevel)
+	})
+	gauge("miflora_rssi_dbm", "Received signal strength of the latest reading.", func(m mifloraDataMetric) float64 {
+		return float64(m.rssi)
+	})
+	family("miflora_firmware_info", "gauge", "Firmware version of the latest reading.", func(id string, sensor *prometheusSensor) {
+		if fresh(sensor) && sensor.lastData.metaData.FirmwareVersion != "" {
+			fmt.Fprintf(w, "miflora_firmware_info{%s} 1\n", prometheusLabels(id, sensor.labels, "version", sensor.lastData.metaData.FirmwareVersion))
+		}
+	})
+
+	family("miflora_last_success_timestamp_seconds", "gauge", "Time of the latest successful reading.", func(id string, sensor *prometheusSensor) {
+		if !sensor.lastSuccess.IsZero() {
+			fmt.Fprintf(w, "miflora_last_success_timestamp_seconds{%s} %d\n", prometheusLabels(id, sensor.labels), sensor.lastSuccess.Unix())
+		}
+	})
+	family("miflora_read_failures_total", "counter", "Failed readings by reason.", func(id string, sensor *prometheusSensor) {
+		reasons := make([]string, 0, len(sensor.failures))
+		for reason := range sensor.failures {
+			reasons = append(reasons, string(reason))
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "miflora_read_failures_total{%s} %d\n",
+				prometheusLabels(id, sensor.labels, "reason", reason), sensor.failures[failureReason(reason)])
+		}
+	})
+	family("miflora_skipped_readings_total", "counter", "Readings skipped since reading other sensors took too long.", func(id string, sensor *prometheusSensor) {
+		fmt.Fprintf(w, "miflora_skipped_readings_total{%s} %d\n", prometheusLabels(id, sensor.labels), sensor.skipped)
+	})
+
+	histogram := func(name string, help string, histogram func(sensor *prometheusSensor) *prometheusHistogram) {
+		family(name, "histogram", help, func(id string, sensor *prometheusSensor) {
+			h := histogram(sensor)
+			cumulative := uint64(0)
+			for i, bound := range prometheusDurationBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, prometheusLabels(id, sensor.labels, "le", formatPrometheusValue(bound)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, prometheusLabels(id, sensor.labels, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", name, prometheusLabels(id, sensor.labels), formatPrometheusValue(h.sum))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", name, prometheusLabels(id, sensor.labels), h.count)
+		})
+	}
+	histogram("miflora_connect_duration_seconds", "Time taken for connecting to the sensor.", func(sensor *prometheusSensor) *prometheusHistogram {
+		return sensor.connectTime
+	})
+	histogram("miflora_readout_duration_seconds", "Time taken for reading the sensor data.", func(sensor *prometheusSensor) *prometheusHistogram {
+		return sensor.readoutTime
+	})
+
+	fmt.Fprintf(w, "# HELP miflorad_broker_connections_lost_total Connections lost to the MQTT broker.\n")
+	fmt.Fprintf(w, "# TYPE miflorad_broker_connections_lost_total counter\n")
+	fmt.Fprintf(w, "miflorad_broker_connections_lost_total %d\n", brokerConnectionsLost.Load())
+	fmt.Fprintf(w, "# HELP miflorad_broker_reconnects_total Reconnections to the MQTT broker.\n")
+	fmt.Fprintf(w, "# TYPE miflorad_broker_reconnects_total counter\n")
+	fmt.Fprintf(w, "miflorad_broker_reconnects_total %d\n", brokerReconnects.Load())
+}
+
+func (e *prometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	settingsLock.RLock()
+	staleness := *prometheusStaleness
+	settingsLock.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.write(w, time.Now(), staleness)
+}
+
+// listens right away to fail early if the address is in use, serving continues in the background
+func serveMetrics(addr string, e *prometheusExporter) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't listen for metrics requests")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "Failed to serve metrics, err: %s\n", err)
+		}
+	}()
+
+	return server, nil
+}
+
+func stopServingMetrics(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
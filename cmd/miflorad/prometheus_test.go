@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	common "miflorad/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusHistogram(t *testing.T) {
+	h := newPrometheusHistogram()
+	for _, value := range []float64{0.1, 0.25, 0.3, 3, 100} {
+		h.observe(value)
+	}
+	assert.Equal(t, []uint64{2, 1, 0, 0, 1, 0, 0, 0, 1}, h.counts)
+	assert.InDelta(t, 103.65, h.sum, 0.001)
+	assert.Equal(t, uint64(5), h.count)
+}
+
+func TestPrometheusLabels(t *testing.T) {
+	assert.Equal(t, `sensor="peri"`, prometheusLabels("peri", peripheralLabels{}))
+	assert.Equal(t, `sensor="peri",name="ficus \"big\"",room="office\\2",reason="connect_error"`,
+		prometheusLabels("peri", peripheralLabels{name: `ficus "big"`, room: `office\2`}, "reason", "connect_error"))
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	e := newPrometheusExporter()
+
+	e.record(mifloraDataMetric{
+		peripheralId: "peri",
+		labels:       peripheralLabels{name: "ficus"},
+		metaData:     common.VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "3.2.1"},
+		sensorData:   common.SensorDataResponse{Temperature: 21.5, Brightness: 1500, Moisture: 35, Conductivity: 420},
+		connectTime:  1.5,
+		readoutTime:  0.2,
+		rssi:         -60,
+	}, now)
+	e.record(mifloraErrorMetric{peripheralId: "peri", labels: peripheralLabels{name: "ficus"}, failed: 1, reason: failureConnect, consecutiveFailures: 1}, now)
+	e.record(mifloraErrorMetric{peripheralId: "peri", labels: peripheralLabels{name: "ficus"}, failed: 2, reason: failureConnect, consecutiveFailures: 3}, now)
+	e.record(mifloraErrorMetric{peripheralId: "other", failed: 1, reason: failureScanTimeout, consecutiveFailures: 1}, now)
+	e.record(mifloraSkippedMetric{peripheralId: "other", skipped: 2}, now)
+	// history metrics are not the latest reading
+	e.record(mifloraHistoryMetric{peripheralId: "peri", labels: peripheralLabels{name: "ficus"}}, now)
+
+	var b strings.Builder
+	e.write(&b, now.Add(1*time.Minute), 10*time.Minute)
+	output := b.String()
+
+	for _, line := range []string{
+		"# TYPE miflora_moisture_percent gauge",
+		`miflora_moisture_percent{sensor="peri",name="ficus"} 35`,
+		`miflora_temperature_celsius{sensor="peri",name="ficus"} 21.5`,
+		`miflora_brightness_lux{sensor="peri",name="ficus"} 1500`,
+		`miflora_conductivity_microsiemens_per_centimeter{sensor="peri",name="ficus"} 420`,
+		`miflora_battery_level_percent{sensor="peri",name="ficus"} 99`,
+		`miflora_rssi_dbm{sensor="peri",name="ficus"} -60`,
+		`miflora_firmware_info{sensor="peri",name="ficus",version="3.2.1"} 1`,
+		`miflora_last_success_timestamp_seconds{sensor="peri",name="ficus"} 1500000000`,
+		"# TYPE miflora_read_failures_total counter",
+		`miflora_read_failures_total{sensor="other",reason="scan_timeout"} 1`,
+		`miflora_read_failures_total{sensor="peri",name="ficus",reason="connect_error"} 3`,
+		`miflora_skipped_readings_total{sensor="other"} 2`,
+		"# TYPE miflora_connect_duration_seconds histogram",
+		`miflora_connect_duration_seconds_bucket{sensor="peri",name="ficus",le="1"} 0`,
+		`miflora_connect_duration_seconds_bucket{sensor="peri",name="ficus",le="2.5"} 1`,
+		`miflora_connect_duration_seconds_bucket{sensor="peri",name="ficus",le="+Inf"} 1`,
+		`miflora_connect_duration_seconds_sum{sensor="peri",name="ficus"} 1.5`,
+		`miflora_connect_duration_seconds_count{sensor="peri",name="ficus"} 1`,
+		`miflora_readout_duration_seconds_bucket{sensor="peri",name="ficus",le="0.25"} 1`,
+		`miflora_readout_duration_seconds_count{sensor="other"} 0`,
+		"miflorad_broker_connections_lost_total 0",
+		"miflorad_broker_reconnects_total 0",
+	} {
+		assert.Contains(t, output, line+"\n")
+	}
+	// sensors never read have no readings
+	assert.NotContains(t, output, `miflora_moisture_percent{sensor="other"}`)
+	assert.NotContains(t, output, `miflora_last_success_timestamp_seconds{sensor="other"}`)
+
+	// stale readings drop out while counters and the last success are kept
+	b.Reset()
+	e.write(&b, now.Add(11*time.Minute), 10*time.Minute)
+	output = b.String()
+	assert.Contains(t, output, "# TYPE miflora_moisture_percent gauge\n")
+	assert.NotContains(t, output, "miflora_moisture_percent{")
+	assert.NotContains(t, output, "miflora_firmware_info{")
+	assert.Contains(t, output, `miflora_last_success_timestamp_seconds{sensor="peri",name="ficus"} 1500000000`)
+	assert.Contains(t, output, `miflora_read_failures_total{sensor="peri",name="ficus",reason="connect_error"} 3`)
+}
+
+func TestPrometheusExporterServeHTTP(t *testing.T) {
+	e := newPrometheusExporter()
+	e.record(mifloraDataMetric{peripheralId: "peri", sensorData: common.SensorDataResponse{Moisture: 35}}, time.Now())
+
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), `miflora_moisture_percent{sensor="peri"} 35`+"\n")
+}
+
+func TestServeMetrics(t *testing.T) {
+	server, err := serveMetrics("127.0.0.1:0", newPrometheusExporter())
+	assert.NoError(t, err)
+	stopServingMetrics(server)
+
+	_, err = serveMetrics("256.0.0.1:0", newPrometheusExporter())
+	assert.Error(t, err)
+}
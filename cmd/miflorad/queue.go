@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	queueFileName       = "queue.jsonl"
+	queueOffsetFileName = "queue.offset"
+	// delay between attempts to publish the oldest queued line while the broker is unreachable
+	queueMinRetryDelay = 1 * time.Second
+	queueMaxRetryDelay = 1 * time.Minute
+)
+
+// a formatted line waiting to be published, the line keeps its original timestamp
+// while values without timestamp are only published within their validity
+type queueEntry struct {
+	PeripheralId string        `json:"peripheral_id"`
+	Line         string        `json:"line"`
+	Topic        string        `json:"topic,omitempty"`
+	Retained     bool          `json:"retained,omitempty"`
+	Queued       time.Time     `json:"queued"`
+	ValidFor     time.Duration `json:"valid_for,omitempty"`
+}
+
+// position after a queued line, only valid as long as the queue file is not compacted
+type queuePosition struct {
+	generation int
+	offset     int64
+}
+
+// Persistent FIFO queue of formatted lines between the formatter and the MQTT publisher.
+// Lines are appended to a file as JSON and the offset of the oldest unpublished line is
+// kept in a second file, so lines are published at least once even across restarts.
+type diskQueue struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	// the clock lines are queued and expired by, only changed by tests
+	now func() time.Time
+
+	// guards all fields below, changed is signalled on push and close
+	lock       sync.Mutex
+	changed    *sync.Cond
+	file       *os.File
+	offsetFile *os.File
+	head       int64
+	size       int64
+	generation int
+	closed     bool
+	done       chan struct{}
+}
+
+// opens the queue in the given directory, lines already queued there will be published first
+func openDiskQueue(dir string, maxSize int64, maxAge time.Duration) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "can't create queue directory")
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, queueFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open queue file")
+	}
+	offsetFile, err := os.OpenFile(filepath.Join(dir, queueOffsetFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "can't open queue offset file")
+	}
+
+	q := &diskQueue{
+		dir:        dir,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		now:        time.Now,
+		file:       file,
+		offsetFile: offsetFile,
+		done:       make(chan struct{}),
+	}
+	q.changed = sync.NewCond(&q.lock)
+
+	if err := q.recover(); err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// restores head and size, a line partially written before a crash is discarded
+func (q *diskQueue) recover() error {
+	data, err := io.ReadAll(q.file)
+	if err != nil {
+		return errors.Wrap(err, "can't read queue file")
+	}
+	q.size = int64(strings.LastIndexByte(string(data), '\n') + 1)
+	if q.size < int64(len(data)) {
+		if err := q.file.Truncate(q.size); err != nil {
+			return errors.Wrap(err, "can't truncate queue file")
+		}
+	}
+
+	offset, err := io.ReadAll(q.offsetFile)
+	if err != nil {
+		return errors.Wrap(err, "can't read queue offset file")
+	}
+	q.head, err = strconv.ParseInt(strings.TrimSpace(string(offset)), 10, 64)
+	// the offset must point to the start of a line else everything is replayed
+	if err != nil || q.head < 0 || q.head > q.size || (q.head > 0 && data[q.head-1] != '\n') {
+		q.head = 0
+	}
+
+	return q.writeOffset()
+}
+
+// must be called with lock held
+func (q *diskQueue) writeOffset() error {
+	_, err := q.offsetFile.WriteAt([]byte(fmt.Sprintf("%020d\n", q.head)), 0)
+	return errors.Wrap(err, "can't write queue offset")
+}
+
+// must be called with lock held
+func (q *diskQueue) readEntryAt(offset int64) (queueEntry, int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(q.file, offset, q.size-offset))
+	data, err := reader.ReadBytes('\n')
+	if err != nil {
+		return queueEntry{}, offset, errors.Wrap(err, "can't read queue file")
+	}
+	next := offset + int64(len(data))
+
+	entry := queueEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return queueEntry{}, next, errors.Wrap(err, "can't parse queued line")
+	}
+	return entry, next, nil
+}
+
+// number of bytes of all unpublished lines
+func (q *diskQueue) length() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size - q.head
+}
+
+func (q *diskQueue) push(line metricLine) error {
+	data, err := json.Marshal(queueEntry{PeripheralId: line.peripheralId, Line: line.line, Topic: line.topic, Retained: line.retained, Queued: q.now(), ValidFor: line.validFor})
+	if err != nil {
+		return errors.Wrap(err, "can't encode line")
+	}
+	data = append(data, '\n')
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, err := q.file.WriteAt(data, q.size); err != nil {
+		return errors.Wrap(err, "can't append to queue file")
+	}
+	q.size += int64(len(data))
+
+	// the oldest lines are dropped once the queue is full
+	for q.maxSize > 0 && q.size-q.head > q.maxSize {
+		q.dropOldest("queue size limit exceeded")
+	}
+	if err := q.compact(); err != nil {
+		return err
+	}
+
+	q.changed.Broadcast()
+	return nil
+}
+
+// must be called with lock held
+func (q *diskQueue) dropOldest(reason string) {
+	entry, next, err := q.readEntryAt(q.head)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Dropping unreadable queued line, err: %s\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "Dropping queued line of peripheral %s, %s\n", entry.PeripheralId, reason)
+		recordPublishFailure(entry.PeripheralId)
+	}
+	if next == q.head {
+		// can't even find the end of the line
+		next = q.size
+	}
+	q.head = next
+	if err := q.writeOffset(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+}
+
+// drops published lines from the queue file, must be called with lock held
+func (q *diskQueue) compact() error {
+	if q.head == q.size && q.size > 0 {
+		// truncate before resetting the offset, a crash in between is detected when recovering
+		if err := q.file.Truncate(0); err != nil {
+			return errors.Wrap(err, "can't truncate queue file")
+		}
+		q.head, q.size = 0, 0
+		q.generation++
+		return q.writeOffset()
+	}
+
+	// rewriting is only worth it once published lines take up as much space as the limit
+	if q.maxSize <= 0 || q.head < q.maxSize {
+		return nil
+	}
+
+	data := make([]byte, q.size-q.head)
+	if _, err := q.file.ReadAt(data, q.head); err != nil {
+		return errors.Wrap(err, "can't read queue file")
+	}
+	tmpPath := filepath.Join(q.dir, queueFileName+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrap(err, "can't write queue file")
+	}
+
+	// reset the offset first, a crash in between only leads to lines published twice
+	head := q.head
+	q.head = 0
+	if err := q.writeOffset(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(q.dir, queueFileName)); err != nil {
+		q.head = head
+		q.writeOffset()
+		return errors.Wrap(err, "can't replace queue file")
+	}
+	file, err := os.OpenFile(filepath.Join(q.dir, queueFileName), os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, "can't open queue file")
+	}
+	q.file.Close()
+	q.file = file
+	q.size = int64(len(data))
+	q.generation++
+	return nil
+}
+
+// waits for the oldest unpublished line and returns it together with the position to
+// acknowledge it with, returns false if the queue is closed and has no more lines
+func (q *diskQueue) peek() (queueEntry, queuePosition, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		for q.head < q.size {
+			entry, next, err := q.readEntryAt(q.head)
+			if err != nil {
+				q.dropOldest("unreadable")
+				continue
+			}
+			if q.maxAge > 0 && q.now().Sub(entry.Queued) > q.maxAge {
+				q.dropOldest("queue age limit exceeded")
+				continue
+			}
+			// a late value would be taken as the current one
+			if entry.ValidFor > 0 && q.now().Sub(entry.Queued) > entry.ValidFor {
+				q.dropOldest("value without timestamp outdated")
+				continue
+			}
+			return entry, queuePosition{generation: q.generation, offset: next}, true
+		}
+		if q.closed {
+			return queueEntry{}, queuePosition{}, false
+		}
+		q.changed.Wait()
+	}
+}
+
+// marks all lines before the given position as published
+func (q *diskQueue) ack(position queuePosition) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if position.generation != q.generation || position.offset <= q.head {
+		// already dropped meanwhile
+		return nil
+	}
+	q.head = position.offset
+	if err := q.writeOffset(); err != nil {
+		return err
+	}
+	return q.compact()
+}
+
+// no more lines will be pushed, peek returns false once all lines are published
+func (q *diskQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+		q.changed.Broadcast()
+	}
+}
+
+func (q *diskQueue) closeFiles() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.file.Close()
+	q.offsetFile.Close()
+}
+
+// queues all lines received from publish until it is closed, then closes the queue
+func spoolMetrics(queue *diskQueue, publish chan metricLine) {
+	defer queue.close()
+
+	for line := range publish {
+		if err := queue.push(line); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to queue line, err: %s\n", err)
+			recordPublishFailure(line.peripheralId)
+		}
+	}
+}
+
+// publishes queued lines in order, a line is retried with increasing delay until it
+// got published, once the queue is closed unpublished lines are left for the next start
+func forwardQueue(queue *diskQueue, publish func(line metricLine) error) {
+	retryDelay := queueMinRetryDelay
+	for {
+		entry, position, ok := queue.peek()
+		if !ok {
+			return
+		}
+
+		err := publish(metricLine{peripheralId: entry.PeripheralId, line: entry.Line, topic: entry.Topic, retained: entry.Retained})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to publish MQTT, keeping %d bytes queued, err: %s\n", queue.length(), err)
+			select {
+			case <-time.After(retryDelay):
+			case <-queue.done:
+				return
+			}
+			retryDelay *= 2
+			if retryDelay > queueMaxRetryDelay {
+				retryDelay = queueMaxRetryDelay
+			}
+			continue
+		}
+		retryDelay = queueMinRetryDelay
+
+		if err := queue.ack(position); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update queue, err: %s\n", err)
+		}
+	}
+}
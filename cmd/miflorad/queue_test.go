@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func pushTestLines(t *testing.T, queue *diskQueue, lines ...string) {
+	for _, line := range lines {
+		assert.NoError(t, queue.push(metricLine{peripheralId: "peri", line: line}))
+	}
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+
+	queue, err := openDiskQueue(dir, 0, 0)
+	assert.NoError(t, err)
+	pushTestLines(t, queue, "foo 1 1500000000", "bar 2 1500000001")
+	assert.NoError(t, queue.push(metricLine{peripheralId: "peri", line: "16", topic: "sensors/peri/moisture", retained: true}))
+
+	entry, position, ok := queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, "peri", entry.PeripheralId)
+	assert.Equal(t, "foo 1 1500000000", entry.Line)
+	assert.NoError(t, queue.ack(position))
+	queue.closeFiles()
+
+	// survives restarts
+	queue, err = openDiskQueue(dir, 0, 0)
+	assert.NoError(t, err)
+	entry, position, ok = queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, "bar 2 1500000001", entry.Line)
+	assert.NoError(t, queue.ack(position))
+	entry, position, ok = queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, queueEntry{PeripheralId: "peri", Line: "16", Topic: "sensors/peri/moisture", Retained: true, Queued: entry.Queued}, entry)
+	assert.NoError(t, queue.ack(position))
+	assert.Equal(t, int64(0), queue.length())
+
+	// published lines are removed from disk
+	info, err := os.Stat(filepath.Join(dir, queueFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	queue.close()
+	_, _, ok = queue.peek()
+	assert.False(t, ok)
+	queue.closeFiles()
+}
+
+func TestDiskQueueRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	queue, err := openDiskQueue(dir, 0, 0)
+	assert.NoError(t, err)
+	pushTestLines(t, queue, "foo 1 1500000000")
+	queue.closeFiles()
+
+	// a crash while appending leaves a partial line and an invalid offset
+	file, err := os.OpenFile(filepath.Join(dir, queueFileName), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	_, err = file.WriteString(`{"peripheral_id":"peri","li`)
+	assert.NoError(t, err)
+	file.Close()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, queueOffsetFileName), []byte("3\n"), 0600))
+
+	queue, err = openDiskQueue(dir, 0, 0)
+	assert.NoError(t, err)
+	defer queue.closeFiles()
+	entry, position, ok := queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, "foo 1 1500000000", entry.Line)
+	assert.NoError(t, queue.ack(position))
+	assert.Equal(t, int64(0), queue.length())
+}
+
+func TestDiskQueueLimits(t *testing.T) {
+	defer takePublishFailures("peri")
+
+	// every line takes up about 80 bytes
+	queue, err := openDiskQueue(t.TempDir(), 400, 0)
+	assert.NoError(t, err)
+	defer queue.closeFiles()
+	for i := 0; i < 20; i++ {
+		pushTestLines(t, queue, fmt.Sprintf("foo %d 1500000000", i))
+	}
+	assert.True(t, queue.length() <= 400)
+
+	// oldest lines are dropped and reported as lost
+	entry, _, ok := queue.peek()
+	assert.True(t, ok)
+	assert.NotEqual(t, "foo 0 1500000000", entry.Line)
+	dropped := takePublishFailures("peri")
+	assert.True(t, dropped > 10)
+
+	// the remaining lines expire while the new one does not
+	now := time.Now()
+	queue.now = func() time.Time { return now }
+	queue.maxAge = 1 * time.Hour
+	now = now.Add(2 * time.Hour)
+	pushTestLines(t, queue, "bar 1 1500000000")
+	// peek must not wait if the new line expired as well
+	queue.close()
+	entry, _, ok = queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, "bar 1 1500000000", entry.Line)
+	assert.Equal(t, 20-dropped, takePublishFailures("peri"))
+}
+
+func TestDiskQueueValidity(t *testing.T) {
+	defer takePublishFailures("peri")
+
+	queue, err := openDiskQueue(t.TempDir(), 0, 0)
+	assert.NoError(t, err)
+	defer queue.closeFiles()
+	now := time.Now()
+	queue.now = func() time.Time { return now }
+
+	assert.NoError(t, queue.push(metricLine{peripheralId: "peri", line: "16", topic: "sensors/peri/moisture", validFor: 25 * time.Second}))
+	pushTestLines(t, queue, "foo 1 1500000000")
+	assert.NoError(t, queue.push(metricLine{peripheralId: "peri", line: "17", topic: "sensors/peri/moisture", validFor: 25 * time.Second}))
+
+	// still valid when the broker comes back quickly
+	entry, _, ok := queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, "16", entry.Line)
+	assert.Equal(t, 25*time.Second, entry.ValidFor)
+
+	// lines with timestamp are kept, outdated values are dropped and reported as lost
+	now = now.Add(1 * time.Minute)
+	assert.NoError(t, queue.push(metricLine{peripheralId: "peri", line: "18", topic: "sensors/peri/moisture", validFor: 25 * time.Second}))
+	entry, position, ok := queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, "foo 1 1500000000", entry.Line)
+	assert.Equal(t, 1, takePublishFailures("peri"))
+	assert.NoError(t, queue.ack(position))
+
+	entry, _, ok = queue.peek()
+	assert.True(t, ok)
+	assert.Equal(t, "18", entry.Line)
+	assert.Equal(t, 1, takePublishFailures("peri"))
+}
+
+func TestForwardQueue(t *testing.T) {
+	queue, err := openDiskQueue(t.TempDir(), 0, 0)
+	assert.NoError(t, err)
+	defer queue.closeFiles()
+	pushTestLines(t, queue, "foo 1 1500000000", "bar 2 1500000001")
+
+	published := []string{}
+	attempts := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forwardQueue(queue, func(line metricLine) error {
+			attempts++
+			// broker comes back after the first attempt
+			if attempts == 1 {
+				return errors.New("Not connected to MQTT broker")
+			}
+			published = append(published, line.line)
+			return nil
+		})
+	}()
+
+	assert.Eventually(t, func() bool { return queue.length() == 0 }, 5*time.Second, 10*time.Millisecond)
+	pushTestLines(t, queue, "baz 3 1500000002")
+	queue.close()
+	<-done
+
+	// replayed in order with original timestamps
+	assert.Equal(t, []string{"foo 1 1500000000", "bar 2 1500000001", "baz 3 1500000002"}, published)
+	assert.Equal(t, int64(0), queue.length())
+}
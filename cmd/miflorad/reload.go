@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// guards settings that may change on reload and are read outside of the goroutine reading the peripherals
+var settingsLock sync.RWMutex
+
+// applies a reloaded config file within the goroutine reading the peripherals
+type reloader struct {
+	requests chan *config
+	// flags given on the command line which take precedence over the config file
+	given    map[string]bool
+	bindKeys map[string][]byte
+	broker   *brokerConnection
+}
+
+// loads the config file again and hands it over to the goroutine reading the peripherals,
+// without config file only the broker TLS files given by flags are checked for changes
+func requestReload(r *reloader) {
+	if *configFile == "" {
+		if r.broker == nil {
+			fmt.Fprintf(os.Stderr, "No config file given, nothing to reload\n")
+			return
+		}
+		// the reloader is not applied at all in this case, so there is no concurrent access
+		fmt.Fprintf(os.Stderr, "No config file given, checking the broker TLS files only...\n")
+		r.reconnectBroker()
+		return
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to reload config, keeping previous one, err: %s\n", err)
+		return
+	}
+
+	select {
+	case r.requests <- cfg:
+		fmt.Fprintf(os.Stderr, "Reloading config file %s...\n", *configFile)
+	default:
+		fmt.Fprintf(os.Stderr, "Reload already pending, ignoring\n")
+	}
+}
+
+func (r *reloader) apply(cfg *config) {
+	previousPublishFormat, previousHomieBaseTopic := *publishFormatFlag, *homieBaseTopic
+	previousPrometheusListen := *prometheusListen
+
+	settingsLock.Lock()
+	applyConfig(cfg, r.given)
+	settingsLock.Unlock()
+
+	added, removed := reloadPeripherals(newPeripherals(cfg, flag.Args(), r.bindKeys))
+	fmt.Fprintf(os.Stderr, "Reloaded config with %d peripheral(s), %d added and %d removed\n", len(allPeripherals), added, removed)
+
+	if *publishFormatFlag != previousPublishFormat {
+		fmt.Fprintf(os.Stderr, "Changing the publish format requires a restart, keeping %s\n", previousPublishFormat)
+	}
+	if *homieBaseTopic != previousHomieBaseTopic && homie != nil {
+		fmt.Fprintf(os.Stderr, "Changing the Homie base topic requires a restart, keeping %s\n", previousHomieBaseTopic)
+	}
+	if influxSink != nil && currentInfluxSettings() != influxSink.settings {
+		fmt.Fprintf(os.Stderr, "Changing the InfluxDB settings requires a restart, keeping the previous ones\n")
+	}
+	if *prometheusListen != previousPrometheusListen {
+		fmt.Fprintf(os.Stderr, "Changing the Prometheus listen address requires a restart, keeping %s\n", previousPrometheusListen)
+	}
+
+	if r.broker == nil {
+		return
+	}
+
+	if err := r.broker.updateSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to update publish settings, keeping previous ones, err: %s\n", err)
+	}
+
+	r.reconnectBroker()
+}
+
+// also reconnects if only the contents of the TLS files changed e.g. due to certificate rotation
+func (r *reloader) reconnectBroker() {
+	if currentBrokerSettings() != r.broker.settings {
+		if err := r.broker.reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect MQTT with new broker settings, err: %s\n", err)
+		}
+	}
+}
+
+// replaces all peripherals with the given ones but keeps the state (e.g. last fetches)
+// of those that are already known, returns the number of added and removed peripherals
+func reloadPeripherals(updated []*peripheral) (int, int) {
+	passiveLock.Lock()
+	defer passiveLock.Unlock()
+
+	added := 0
+	for i, p := range updated {
+		existing := findPeripheral(p.id)
+		if existing == nil {
+			added++
+			continue
+		}
+		existing.labels = p.labels
+		existing.interval = p.interval
+		existing.readRetries = p.readRetries
+		existing.scanTimeout = p.scanTimeout
+		existing.bindKey = p.bindKey
+		updated[i] = existing
+	}
+	removed := len(allPeripherals) - (len(updated) - added)
+
+	allPeripherals = updated
+	return added, removed
+}
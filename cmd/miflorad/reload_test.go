@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadPeripherals(t *testing.T) {
+	lastDataFetch := time.Now().Add(-5 * time.Minute)
+	kept := &peripheral{id: "C4:7C:8D:66:D5:27", lastDataFetch: lastDataFetch}
+	allPeripherals = []*peripheral{kept, {id: "C4:7C:8D:66:D5:28"}}
+	defer func() { allPeripherals = nil }()
+
+	added, removed := reloadPeripherals([]*peripheral{
+		{id: "C4:7C:8D:66:D5:29"},
+		{id: "c4:7c:8d:66:d5:27", labels: peripheralLabels{name: "ficus"}, interval: 10 * time.Minute},
+	})
+
+	assert.Equal(t, 1, added)
+	assert.Equal(t, 1, removed)
+	assert.Len(t, allPeripherals, 2)
+	assert.Equal(t, "C4:7C:8D:66:D5:29", allPeripherals[0].id)
+	assert.Same(t, kept, allPeripherals[1])
+	assert.Equal(t, lastDataFetch, allPeripherals[1].lastDataFetch)
+	assert.Equal(t, "ficus", allPeripherals[1].labels.name)
+	assert.Equal(t, 10*time.Minute, allPeripherals[1].getInterval())
+}
+
+func TestReloaderApply(t *testing.T) {
+	// resets all flags to their defaults
+	defer applyConfig(&config{}, map[string]bool{})
+
+	setTestPeripherals("C4:7C:8D:66:D5:27", "C4:7C:8D:66:D5:28")
+	defer func() { allPeripherals = nil }()
+	allPeripherals[0].lastMetaDataFetch = time.Now()
+
+	cfg, err := loadConfig("miflorad.example.yaml")
+	assert.NoError(t, err)
+
+	r := &reloader{given: map[string]bool{"interval": true}}
+	r.apply(cfg)
+
+	assert.Equal(t, "office", *graphitePrefix)
+	assert.Equal(t, 25*time.Second, *interval)
+	assert.Len(t, allPeripherals, 2)
+	assert.Equal(t, "ficus-reception", allPeripherals[0].labels.name)
+	assert.False(t, allPeripherals[0].lastMetaDataFetch.Before(time.Now().Add(-time.Minute)))
+	assert.Equal(t, "cactus-kitchen", allPeripherals[1].labels.name)
+}
+
+func TestRequestReloadWithoutConfigFile(t *testing.T) {
+	defer applyConfig(&config{}, map[string]bool{})
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "gateway")
+	assert.NoError(t, flag.Set("brokercertfile", certFile))
+	assert.NoError(t, flag.Set("brokerkeyfile", keyFile))
+
+	previous := &fakeMQTTClient{connected: true}
+	reconnects := 0
+	broker := &brokerConnection{client: previous, settings: currentBrokerSettings(), connect: func(bool) (mqtt.Client, error) {
+		reconnects++
+		return &fakeMQTTClient{connected: true}, nil
+	}}
+	r := &reloader{requests: make(chan *config, 1), broker: broker}
+
+	// nothing changed
+	requestReload(r)
+	assert.Equal(t, 0, reconnects)
+	assert.Same(t, previous, broker.client)
+
+	// rotated certificate given by flags only
+	writeTestCertificate(t, dir, "gateway")
+	requestReload(r)
+	assert.Equal(t, 1, reconnects)
+	assert.NotSame(t, previous, broker.client)
+	assert.False(t, previous.connected)
+	assert.Equal(t, currentBrokerSettings(), broker.settings)
+	assert.Empty(t, r.requests)
+}
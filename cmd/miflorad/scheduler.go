@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	common "miflorad/common"
+)
+
+// Every peripheral has its own schedule: its interval is divided into consecutive slots
+// and it is read once per slot at a random offset of up to -jitter into the slot.
+// Peripherals are read one after another (the BLE adapter handles a single connection
+// at a time anyway) so readings of the same peripheral never overlap. If reading other
+// peripherals takes longer than an interval, the missed slots are reported as skipped.
+
+// schedules the next reading of the peripheral within the slot starting at the given time
+func (p *peripheral) schedule(slot time.Time) {
+	p.slot = slot
+	p.nextDue = slot.Add(jitterOffset(p.getInterval()))
+}
+
+// random offset into a slot that is kept shorter than the interval
+func jitterOffset(interval time.Duration) time.Duration {
+	jitter := *jitterFlag
+	if jitter > interval/2 {
+		jitter = interval / 2
+	}
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// peripherals that were never scheduled (e.g. added on reload) are due immediately
+func (p *peripheral) isScheduled() bool {
+	return !p.slot.IsZero()
+}
+
+func (p *peripheral) isDue(now time.Time) bool {
+	return !p.isScheduled() || !p.nextDue.After(now)
+}
+
+// advances the current slot to the one containing now and returns the number of slots passed over
+func (p *peripheral) takeSkippedSlots(now time.Time) int {
+	if !p.isScheduled() {
+		return 0
+	}
+	skipped := int(now.Sub(p.slot) / p.getInterval())
+	if skipped > 0 {
+		p.slot = p.slot.Add(time.Duration(skipped) * p.getInterval())
+	}
+	return skipped
+}
+
+// the due peripheral not yet in read that was due first, nil if there is none
+func nextDuePeripheral(now time.Time, read map[*peripheral]bool) *peripheral {
+	var next *peripheral
+	for _, peripheral := range allPeripherals {
+		if read[peripheral] || !peripheral.isDue(now) {
+			continue
+		}
+		if next == nil || (next.isScheduled() && (!peripheral.isScheduled() || peripheral.nextDue.Before(next.nextDue))) {
+			next = peripheral
+		}
+	}
+	return next
+}
+
+// time at which the next peripheral becomes due, one interval from now if there are none
+func nextDueTime(now time.Time) time.Time {
+	if len(allPeripherals) == 0 {
+		return now.Add(*interval)
+	}
+	next := allPeripherals[0].nextDue
+	for _, peripheral := range allPeripherals {
+		if !peripheral.isScheduled() {
+			return now
+		}
+		if peripheral.nextDue.Before(next) {
+			next = peripheral.nextDue
+		}
+	}
+	return next
+}
+
+func (p *peripheral) recordSkipped(send chan mifloraMetric, skipped int) {
+	send <- mifloraSkippedMetric{
+		peripheralId: common.MifloraGetAlphaNumericID(p.id),
+		labels:       p.labels,
+		skipped:      skipped,
+		interval:     p.getInterval(),
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sim "miflorad/common/sim"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeripheralSchedule(t *testing.T) {
+	now := time.Now()
+	tick := 1 * time.Minute
+
+	// never scheduled
+	p := &peripheral{interval: 10 * tick}
+	assert.True(t, p.isDue(now))
+	assert.Equal(t, 0, p.takeSkippedSlots(now))
+
+	p.schedule(now)
+	assert.Equal(t, now, p.nextDue)
+	assert.True(t, p.isDue(now))
+	assert.False(t, p.isDue(now.Add(-time.Second)))
+
+	// read within the slot
+	assert.Equal(t, 0, p.takeSkippedSlots(now.Add(9*tick)))
+	assert.Equal(t, now, p.slot)
+
+	// two slots passed over
+	assert.Equal(t, 2, p.takeSkippedSlots(now.Add(25*tick)))
+	assert.Equal(t, now.Add(20*tick), p.slot)
+}
+
+func TestJitterOffset(t *testing.T) {
+	defer func() { *jitterFlag = 0 }()
+
+	assert.Equal(t, time.Duration(0), jitterOffset(time.Minute))
+
+	*jitterFlag = 10 * time.Second
+	for i := 0; i < 100; i++ {
+		offset := jitterOffset(time.Minute)
+		assert.True(t, offset >= 0 && offset < 10*time.Second)
+	}
+
+	// kept within the first half of short intervals
+	for i := 0; i < 100; i++ {
+		assert.True(t, jitterOffset(4*time.Second) < 2*time.Second)
+	}
+}
+
+func TestReadDuePeripherals(t *testing.T) {
+	simPeripheral1 := newTestSimPeripheral("C4:7C:8D:66:D5:27")
+	simPeripheral2 := newTestSimPeripheral("C4:7C:8D:66:D5:28")
+	backend := sim.NewBackend(simPeripheral1, simPeripheral2)
+	setTestPeripherals("C4:7C:8D:66:D5:27", "C4:7C:8D:66:D5:28")
+	defer func() { allPeripherals = nil }()
+	allPeripherals[0].interval = 1 * time.Hour
+	allPeripherals[1].interval = 2 * time.Hour
+
+	ctx := context.Background()
+	send := make(chan mifloraMetric, 10)
+
+	// all are read initially
+	start := time.Now()
+	assert.Equal(t, allPeripherals, readDuePeripherals(ctx, backend, send))
+	assert.Len(t, receiveMetrics(send), 2)
+	assert.Equal(t, 1, simPeripheral1.Connects)
+	assert.Equal(t, 1, simPeripheral2.Connects)
+	assert.True(t, nextDueTime(start).After(start.Add(59*time.Minute)))
+
+	// none is due yet
+	assert.Empty(t, readDuePeripherals(ctx, backend, send))
+	assert.Empty(t, receiveMetrics(send))
+
+	// the first one missed two slots while the second one is just due
+	allPeripherals[0].schedule(allPeripherals[0].slot.Add(-3 * time.Hour))
+	allPeripherals[1].schedule(allPeripherals[1].slot.Add(-2 * time.Hour))
+	readDuePeripherals(ctx, backend, send)
+
+	metrics := receiveMetrics(send)
+	assert.Len(t, metrics, 3)
+	assert.Equal(t, mifloraSkippedMetric{peripheralId: "c47c8d66d527", skipped: 2, interval: 1 * time.Hour}, metrics[0])
+	assert.IsType(t, mifloraDataMetric{}, metrics[1])
+	assert.IsType(t, mifloraDataMetric{}, metrics[2])
+	assert.True(t, allPeripherals[0].slot.After(start.Add(59*time.Minute)))
+	assert.True(t, allPeripherals[1].slot.After(start.Add(119*time.Minute)))
+}
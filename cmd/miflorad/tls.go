@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS config for the MQTT broker connection, the files are read on every call
+func newTLSConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[*brokerTLSMinVersion]
+	if !ok {
+		return nil, errors.Errorf("Unsupported minimum TLS version %s", *brokerTLSMinVersion)
+	}
+
+	config := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: *brokerServerName,
+	}
+
+	if *brokerCAFile != "" {
+		data, err := os.ReadFile(*brokerCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("No certificates found in CA file %s", *brokerCAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if *brokerCertFile != "" || *brokerKeyFile != "" {
+		if *brokerCertFile == "" || *brokerKeyFile == "" {
+			return nil, errors.New("Client certificate and key file must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(*brokerCertFile, *brokerKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// digest of the contents of all TLS files so that rotated files are detected on reload
+func tlsFilesDigest() string {
+	hash := sha256.New()
+	for _, path := range []string{*brokerCAFile, *brokerCertFile, *brokerKeyFile} {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// unreadable files are reported when connecting
+			fmt.Fprintf(hash, "%s: %s", path, err)
+			continue
+		}
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writes a self-signed certificate and its key as PEM files
+func writeTestCertificate(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	defer applyConfig(&config{}, map[string]bool{})
+	dir := t.TempDir()
+	caFile, _ := writeTestCertificate(t, dir, "ca")
+	certFile, keyFile := writeTestCertificate(t, dir, "gateway")
+
+	// system roots by default
+	tlsConfig, err := newTLSConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig.RootCAs)
+	assert.Empty(t, tlsConfig.Certificates)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+
+	cfg := &config{}
+	cfg.Broker.CAFile = caFile
+	cfg.Broker.CertFile = certFile
+	cfg.Broker.KeyFile = keyFile
+	cfg.Broker.ServerName = "mqtt.internal"
+	cfg.Broker.TLSMinVersion = "1.3"
+	applyConfig(cfg, map[string]bool{})
+
+	tlsConfig, err = newTLSConfig()
+	assert.NoError(t, err)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.Equal(t, "mqtt.internal", tlsConfig.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+
+	// invalid settings
+	cfg.Broker.TLSMinVersion = "1.4"
+	applyConfig(cfg, map[string]bool{})
+	_, err = newTLSConfig()
+	assert.Error(t, err)
+
+	cfg.Broker.TLSMinVersion = ""
+	cfg.Broker.KeyFile = ""
+	applyConfig(cfg, map[string]bool{})
+	_, err = newTLSConfig()
+	assert.Error(t, err)
+
+	cfg.Broker.KeyFile = keyFile
+	cfg.Broker.CAFile = keyFile
+	applyConfig(cfg, map[string]bool{})
+	_, err = newTLSConfig()
+	assert.Error(t, err)
+}
+
+func TestTLSFilesDigest(t *testing.T) {
+	defer applyConfig(&config{}, map[string]bool{})
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "gateway")
+
+	cfg := &config{}
+	cfg.Broker.CertFile = certFile
+	cfg.Broker.KeyFile = keyFile
+	applyConfig(cfg, map[string]bool{})
+
+	digest := tlsFilesDigest()
+	assert.Equal(t, digest, tlsFilesDigest())
+
+	// rotated certificate
+	writeTestCertificate(t, dir, "gateway")
+	assert.NotEqual(t, digest, tlsFilesDigest())
+}
@@ -1,9 +1,13 @@
 package ble
 
 import (
+	"context"
+	"strings"
+
 	"miflorad/common"
 
 	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/examples/lib/dev"
 	"github.com/pkg/errors"
 )
 
@@ -27,59 +31,131 @@ func FindCharacteristicByUUID(characteristics []*ble.Characteristic, uuid string
 	return nil
 }
 
-func RequestVersionBattery(client ble.Client) (common.VersionBatteryResponse, error) {
-	mifloraService := FindServiceByUUID(client.Profile().Services, common.MifloraServiceUUID)
-	if mifloraService == nil {
-		return common.VersionBatteryResponse{}, errors.New("Failed to get the miflora service")
+var _ common.MifloraBackend = (*Backend)(nil)
+
+// implements common.MifloraBackend using github.com/go-ble/ble
+type Backend struct {
+	device ble.Device
+}
+
+// opens the default HCI device and makes it the default device of go-ble
+func NewBackend() (*Backend, error) {
+	device, err := dev.NewDevice("default")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open device")
 	}
+	ble.SetDefaultDevice(device)
 
-	mifloraVersionBatteryChar := FindCharacteristicByUUID(mifloraService.Characteristics, common.MifloraCharVersionBatteryUUID)
-	if mifloraVersionBatteryChar == nil {
-		return common.VersionBatteryResponse{}, errors.New("Failed to get the version battery characteristic")
+	return &Backend{device: device}, nil
+}
+
+func (b *Backend) Connect(ctx context.Context, peripheralID string) (common.MifloraConn, error) {
+	// only way to get back the found advertisement, must be buffered!
+	foundAdvertisementChannel := make(chan ble.Advertisement, 1)
+
+	filter := func(adv ble.Advertisement) bool {
+		if strings.EqualFold(adv.Addr().String(), peripheralID) {
+			foundAdvertisementChannel <- adv
+			return true
+		}
+		return false
 	}
 
-	bytes, err := client.ReadCharacteristic(mifloraVersionBatteryChar)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client, err := ble.Connect(ble.WithSigHandler(ctx, cancel), filter)
 	if err != nil {
-		return common.VersionBatteryResponse{}, errors.Wrap(err, "can't read version battery")
+		return nil, errors.Wrapf(err, "can't connect to %s", peripheralID)
 	}
 
-	return common.ParseVersionBattery(bytes), nil
-}
+	c := &conn{
+		client: client,
+		rssi:   (<-foundAdvertisementChannel).RSSI(),
+		done:   make(chan struct{}),
+	}
 
-func RequestModeChange(client ble.Client) error {
-	mifloraService := FindServiceByUUID(client.Profile().Services, common.MifloraServiceUUID)
-	if mifloraService == nil {
-		return errors.New("Failed to get the miflora service")
+	// Source: https://github.com/go-ble/ble/blob/master/examples/basic/explorer/main.go#L53
+	// Normally, the connection is disconnected by us after our exploration.
+	// However, it can be asynchronously disconnected by the remote peripheral.
+	// So we wait(detect) the disconnection in the go routine.
+	go func() {
+		<-client.Disconnected()
+		close(c.done)
+	}()
+
+	if _, err := client.DiscoverProfile(true); err != nil {
+		c.Close()
+		return nil, &common.ProfileDiscoveryError{Err: err}
 	}
 
-	mifloraModeChangeChar := FindCharacteristicByUUID(mifloraService.Characteristics, common.MifloraCharModeChangeUUID)
-	if mifloraModeChangeChar == nil {
-		return errors.New("Failed to discover the mode change characteristic")
+	return c, nil
+}
+
+func (b *Backend) Stop() error {
+	return b.device.Stop()
+}
+
+var _ common.MifloraConn = (*conn)(nil)
+
+// implements common.MifloraConn for a connected ble.Client
+type conn struct {
+	client ble.Client
+	rssi   int
+	done   chan struct{}
+}
+
+func (c *conn) findCharacteristic(uuid string) (*ble.Characteristic, error) {
+	for _, service := range c.client.Profile().Services {
+		if characteristic := FindCharacteristicByUUID(service.Characteristics, uuid); characteristic != nil {
+			return characteristic, nil
+		}
 	}
+	return nil, &common.ProfileDiscoveryError{Err: errors.Errorf("Failed to discover the characteristic %s", uuid)}
+}
 
-	err := client.WriteCharacteristic(mifloraModeChangeChar, common.MifloraGetModeChangeData(), false)
+func (c *conn) ReadCharacteristic(uuid string) ([]byte, error) {
+	characteristic, err := c.findCharacteristic(uuid)
 	if err != nil {
-		return errors.Wrap(err, "can't change mode")
+		return nil, err
 	}
 
-	return nil
+	return c.client.ReadCharacteristic(characteristic)
 }
 
-func RequestSensorData(client ble.Client) (common.SensorDataResponse, error) {
-	mifloraService := FindServiceByUUID(client.Profile().Services, common.MifloraServiceUUID)
-	if mifloraService == nil {
-		return common.SensorDataResponse{}, errors.New("Failed to get the miflora service")
+func (c *conn) WriteCharacteristic(uuid string, data []byte) error {
+	characteristic, err := c.findCharacteristic(uuid)
+	if err != nil {
+		return err
 	}
 
-	mifloraSensorDataChar := FindCharacteristicByUUID(mifloraService.Characteristics, common.MifloraCharReadSensorDataUUID)
-	if mifloraSensorDataChar == nil {
-		return common.SensorDataResponse{}, errors.New("Failed to discover the sensor data characteristic")
-	}
+	return c.client.WriteCharacteristic(characteristic, data, false)
+}
 
-	bytes, err := client.ReadCharacteristic(mifloraSensorDataChar)
+func (c *conn) SubscribeCharacteristic(uuid string, handler func(data []byte)) error {
+	characteristic, err := c.findCharacteristic(uuid)
 	if err != nil {
-		return common.SensorDataResponse{}, errors.Wrap(err, "can't read sensor data")
+		return err
 	}
 
-	return common.ParseSensorData(bytes), nil
+	return c.client.Subscribe(characteristic, false, handler)
+}
+
+func (c *conn) RSSI() int {
+	return c.rssi
+}
+
+func (c *conn) Disconnected() <-chan struct{} {
+	return c.done
+}
+
+func (c *conn) Close() error {
+	err := c.client.CancelConnection()
+
+	<-c.done
+
+	if err != nil {
+		return errors.Wrap(err, "can't disconnect")
+	}
+	return nil
 }
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// AES-CCM as specified in RFC 3610 since the Go standard library does not provide it,
+// only decryption is implemented as that is all MiBeacon support needs
+func aesCCMOpen(key, nonce, ciphertext, tag, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create AES cipher")
+	}
+
+	tagSize := len(tag)
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, errors.Errorf("invalid CCM tag size %d", tagSize)
+	}
+
+	lengthSize := 15 - len(nonce)
+	if lengthSize < 2 || lengthSize > 8 {
+		return nil, errors.Errorf("invalid CCM nonce size %d", len(nonce))
+	}
+	if lengthSize < 8 && uint64(len(ciphertext)) >= uint64(1)<<(8*lengthSize) {
+		return nil, errors.New("CCM ciphertext too long for nonce size")
+	}
+
+	// counter mode keystream, A_0 is reserved for encrypting the tag
+	counter := make([]byte, aes.BlockSize)
+	counter[0] = byte(lengthSize - 1)
+	copy(counter[1:], nonce)
+	keystream := make([]byte, aes.BlockSize)
+
+	plaintext := make([]byte, len(ciphertext))
+	for i := 0; i < len(ciphertext); i += aes.BlockSize {
+		putCCMCounter(counter, lengthSize, uint64(i/aes.BlockSize+1))
+		block.Encrypt(keystream, counter)
+		for j := i; j < len(ciphertext) && j < i+aes.BlockSize; j++ {
+			plaintext[j] = ciphertext[j] ^ keystream[j-i]
+		}
+	}
+
+	expectedTag := ccmMAC(block, nonce, plaintext, additionalData, tagSize, lengthSize)
+	putCCMCounter(counter, lengthSize, 0)
+	block.Encrypt(keystream, counter)
+	for i := range expectedTag {
+		expectedTag[i] ^= keystream[i]
+	}
+
+	if subtle.ConstantTimeCompare(expectedTag, tag) != 1 {
+		return nil, errors.New("CCM authentication failed")
+	}
+
+	return plaintext, nil
+}
+
+func putCCMCounter(block []byte, lengthSize int, value uint64) {
+	for i := 0; i < lengthSize; i++ {
+		block[aes.BlockSize-1-i] = byte(value >> (8 * i))
+	}
+}
+
+// computes the CBC-MAC over the formatted B_0 block, additional data and plaintext
+func ccmMAC(block cipher.Block, nonce, plaintext, additionalData []byte, tagSize, lengthSize int) []byte {
+	mac := make([]byte, aes.BlockSize)
+
+	flags := byte(((tagSize-2)/2)<<3 | (lengthSize - 1))
+	if len(additionalData) > 0 {
+		flags |= 0x40
+	}
+	mac[0] = flags
+	copy(mac[1:], nonce)
+	putCCMCounter(mac, lengthSize, uint64(len(plaintext)))
+	block.Encrypt(mac, mac)
+
+	cbc := func(data []byte) {
+		for i := 0; i < len(data); i += aes.BlockSize {
+			for j := i; j < len(data) && j < i+aes.BlockSize; j++ {
+				mac[j-i] ^= data[j]
+			}
+			block.Encrypt(mac, mac)
+		}
+	}
+
+	if len(additionalData) > 0 {
+		// only short additional data (< 0xff00 bytes) is supported
+		encoded := make([]byte, 2+len(additionalData))
+		binary.BigEndian.PutUint16(encoded, uint16(len(additionalData)))
+		copy(encoded[2:], additionalData)
+		cbc(encoded)
+	}
+	cbc(plaintext)
+
+	return mac[:tagSize]
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustDecodeHex(s string) []byte {
+	bytes, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return bytes
+}
+
+func TestAESCCMOpen(t *testing.T) {
+	// Source: https://datatracker.ietf.org/doc/html/rfc3610#section-8 (packet vectors #1 and #2)
+	tables := []struct {
+		nonce          string
+		additionalData string
+		ciphertext     string
+		tag            string
+		plaintext      string
+	}{
+		{
+			"00000003020100a0a1a2a3a4a5",
+			"0001020304050607",
+			"588c979a61c663d2f066d0c2c0f989806d5f6b61dac384",
+			"17e8d12cfdf926e0",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+		},
+		{
+			"00000004030201a0a1a2a3a4a5",
+			"0001020304050607",
+			"72c91a36e135f8cf291ca894085c87e3cc15c439c9e43a3b",
+			"a091d56e10400916",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		},
+	}
+
+	key := mustDecodeHex("c0c1c2c3c4c5c6c7c8c9cacbcccdcecf")
+
+	for _, table := range tables {
+		plaintext, err := aesCCMOpen(key, mustDecodeHex(table.nonce), mustDecodeHex(table.ciphertext),
+			mustDecodeHex(table.tag), mustDecodeHex(table.additionalData))
+		assert.NoError(t, err)
+		assert.Equal(t, mustDecodeHex(table.plaintext), plaintext)
+
+		tamperedTag := mustDecodeHex(table.tag)
+		tamperedTag[0] ^= 0x01
+		_, err = aesCCMOpen(key, mustDecodeHex(table.nonce), mustDecodeHex(table.ciphertext),
+			tamperedTag, mustDecodeHex(table.additionalData))
+		assert.Error(t, err)
+	}
+}
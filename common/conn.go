@@ -0,0 +1,218 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// abstracts a connection to a miflora device independent of the used BLE library
+type MifloraConn interface {
+	// characteristics are identified by their full UUID e.g. MifloraCharVersionBatteryUUID
+	ReadCharacteristic(uuid string) ([]byte, error)
+	WriteCharacteristic(uuid string, data []byte) error
+	// handler is called for every notification until the connection is closed
+	SubscribeCharacteristic(uuid string, handler func(data []byte)) error
+	// signal strength in dBm as seen when discovering the device
+	RSSI() int
+	// closed once the connection is closed or lost e.g. when the device drops it
+	Disconnected() <-chan struct{}
+	Close() error
+}
+
+// abstracts a BLE library that is able to connect to miflora devices
+type MifloraBackend interface {
+	// scans for the device with the given peripheral ID (MAC address) and connects to it
+	Connect(ctx context.Context, peripheralID string) (MifloraConn, error)
+	Stop() error
+}
+
+// returned by backends if services or characteristics of the device could not be discovered
+type ProfileDiscoveryError struct {
+	Err error
+}
+
+func (e *ProfileDiscoveryError) Error() string {
+	return fmt.Sprintf("can't discover profile: %s", e.Err)
+}
+
+func (e *ProfileDiscoveryError) Unwrap() error {
+	return e.Err
+}
+
+func RequestVersionBattery(conn MifloraConn) (VersionBatteryResponse, error) {
+	bytes, err := conn.ReadCharacteristic(MifloraCharVersionBatteryUUID)
+	if err != nil {
+		return VersionBatteryResponse{}, errors.Wrap(err, "can't read version battery")
+	}
+
+	return ParseVersionBattery(bytes)
+}
+
+func RequestSensorInfo(conn MifloraConn) (SensorInfo, error) {
+	bytes, err := conn.ReadCharacteristic(CharDeviceNameUUID)
+	if err != nil {
+		return SensorInfo{}, errors.Wrap(err, "can't read device name")
+	}
+
+	deviceName, err := ParseDeviceName(bytes)
+	if err != nil {
+		return SensorInfo{}, err
+	}
+
+	bytes, err = conn.ReadCharacteristic(CharAppearanceUUID)
+	if err != nil {
+		return SensorInfo{}, errors.Wrap(err, "can't read appearance")
+	}
+
+	appearance, err := ParseAppearance(bytes)
+	if err != nil {
+		return SensorInfo{}, err
+	}
+
+	metaData, err := RequestVersionBattery(conn)
+	if err != nil {
+		return SensorInfo{}, err
+	}
+
+	return SensorInfo{
+		DeviceName:      deviceName,
+		Appearance:      appearance,
+		FirmwareVersion: metaData.FirmwareVersion,
+	}, nil
+}
+
+func RequestModeChange(conn MifloraConn) error {
+	err := conn.WriteCharacteristic(MifloraCharModeChangeUUID, MifloraGetModeChangeData())
+	if err != nil {
+		return errors.Wrap(err, "can't change mode")
+	}
+
+	return nil
+}
+
+func RequestBlink(conn MifloraConn) error {
+	err := conn.WriteCharacteristic(MifloraCharModeChangeUUID, MifloraGetBlinkData())
+	if err != nil {
+		return errors.Wrap(err, "can't blink")
+	}
+
+	return nil
+}
+
+func RequestSensorData(conn MifloraConn) (SensorDataResponse, error) {
+	bytes, err := conn.ReadCharacteristic(MifloraCharReadSensorDataUUID)
+	if err != nil {
+		return SensorDataResponse{}, errors.Wrap(err, "can't read sensor data")
+	}
+
+	return ParseSensorData(bytes)
+}
+
+// enables notifications of the current sensor data which the device then sends about every second
+func SubscribeSensorData(conn MifloraConn, metaData VersionBatteryResponse, handler func(SensorDataResponse, error)) error {
+	if metaData.RequiresModeChangeBeforeRead() {
+		err := RequestModeChange(conn)
+		if err != nil {
+			return errors.Wrap(err, "can't request mode change")
+		}
+	}
+
+	err := conn.SubscribeCharacteristic(MifloraCharReadSensorDataUUID, func(bytes []byte) {
+		handler(ParseSensorData(bytes))
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't subscribe sensor data")
+	}
+
+	return nil
+}
+
+func RequestDeviceTime(conn MifloraConn) (DeviceTimeResponse, error) {
+	bytes, err := conn.ReadCharacteristic(MifloraCharHistoryDeviceTimeUUID)
+	if err != nil {
+		return DeviceTimeResponse{}, errors.Wrap(err, "can't read device time")
+	}
+
+	return ParseDeviceTime(bytes, time.Now())
+}
+
+// reads the history entries recorded after the given device time (0 for all) in chronological
+// order, walking from the newest entry backwards so older entries cost no round-trips
+func RequestHistory(conn MifloraConn, since uint32) ([]HistoryEntryResponse, error) {
+	err := conn.WriteCharacteristic(MifloraCharHistoryControlUUID, MifloraGetHistoryInitData())
+	if err != nil {
+		return nil, errors.Wrap(err, "can't init history")
+	}
+
+	bytes, err := conn.ReadCharacteristic(MifloraCharHistoryReadUUID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read history count")
+	}
+
+	historyCount, err := ParseHistoryCount(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []HistoryEntryResponse{}
+	for index := int(historyCount.EntryCount) - 1; index >= 0; index-- {
+		err := conn.WriteCharacteristic(MifloraCharHistoryControlUUID, MifloraGetHistoryEntryAddressData(uint16(index)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't address history entry %d", index)
+		}
+
+		bytes, err := conn.ReadCharacteristic(MifloraCharHistoryReadUUID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't read history entry %d", index)
+		}
+
+		entry, err := ParseHistoryEntry(bytes)
+		if err == ErrPlaceholderData {
+			// the device reports unused entries this way, skip them
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't parse history entry %d", index)
+		}
+		if entry.DeviceTime <= since {
+			break
+		}
+
+		entries = append(entries, entry)
+	}
+
+	// newest first so far
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// reads the current sensor data and (if requested or never read before) the meta data,
+// the given meta data is returned unchanged if it is not re-requested
+func ReadMiflora(conn MifloraConn, metaData VersionBatteryResponse, refreshMetaData bool) (VersionBatteryResponse, SensorDataResponse, error) {
+	if refreshMetaData || metaData.FirmwareVersion == "" {
+		var err error
+		metaData, err = RequestVersionBattery(conn)
+		if err != nil {
+			return VersionBatteryResponse{}, SensorDataResponse{}, errors.Wrap(err, "can't request version battery")
+		}
+	}
+
+	if metaData.RequiresModeChangeBeforeRead() {
+		err2 := RequestModeChange(conn)
+		if err2 != nil {
+			return metaData, SensorDataResponse{}, errors.Wrap(err2, "can't request mode change")
+		}
+	}
+
+	sensorData, err3 := RequestSensorData(conn)
+	if err3 != nil {
+		return metaData, SensorDataResponse{}, errors.Wrap(err3, "can't request sensor data")
+	}
+
+	return metaData, sensorData, nil
+}
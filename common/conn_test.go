@@ -0,0 +1,181 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// records writes and answers reads from fixed characteristic values
+type fakeConn struct {
+	values map[string][]byte
+	writes []string
+	// history entries by index, selected via writes to the history control characteristic
+	history        [][]byte
+	historyAddress []byte
+	// subscribed handlers by characteristic
+	handlers map[string]func([]byte)
+}
+
+func (c *fakeConn) ReadCharacteristic(uuid string) ([]byte, error) {
+	if uuid == MifloraCharHistoryReadUUID && c.historyAddress != nil && c.historyAddress[0] == 0xa1 {
+		return c.history[int(c.historyAddress[1])|int(c.historyAddress[2])<<8], nil
+	}
+	value, ok := c.values[uuid]
+	if !ok {
+		return nil, errors.Errorf("unknown characteristic %s", uuid)
+	}
+	return value, nil
+}
+
+func (c *fakeConn) WriteCharacteristic(uuid string, data []byte) error {
+	c.writes = append(c.writes, uuid)
+	if uuid == MifloraCharHistoryControlUUID {
+		c.historyAddress = data
+	}
+	return nil
+}
+
+func (c *fakeConn) SubscribeCharacteristic(uuid string, handler func(data []byte)) error {
+	if c.handlers == nil {
+		c.handlers = map[string]func([]byte){}
+	}
+	c.handlers[uuid] = handler
+	return nil
+}
+
+func (c *fakeConn) RSSI() int {
+	return -42
+}
+
+func (c *fakeConn) Disconnected() <-chan struct{} {
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func TestReadMiflora(t *testing.T) {
+	tables := []struct {
+		firmware   []byte
+		modeChange bool
+	}{
+		{[]byte{0x64, 0x15, 0x32, 0x2e, 0x37, 0x2e, 0x30}, true},
+		{[]byte{0x64, 0x15, 0x32, 0x2e, 0x36, 0x2e, 0x32}, false},
+	}
+
+	for _, table := range tables {
+		conn := &fakeConn{values: map[string][]byte{
+			MifloraCharVersionBatteryUUID: table.firmware,
+			MifloraCharReadSensorDataUUID: {0xf2, 0x00, 0x00, 0x79, 0x00, 0x00, 0x00, 0x10, 0x65, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		}}
+
+		expectedMetaData, err := ParseVersionBattery(table.firmware)
+		assert.NoError(t, err)
+
+		metaData, sensorData, err := ReadMiflora(conn, VersionBatteryResponse{}, false)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedMetaData, metaData)
+		assert.Equal(t, SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101}, sensorData)
+		if table.modeChange {
+			assert.Equal(t, []string{MifloraCharModeChangeUUID}, conn.writes)
+		} else {
+			assert.Empty(t, conn.writes)
+		}
+	}
+
+	// keeps given meta data without reading it again
+	conn := &fakeConn{values: map[string][]byte{
+		MifloraCharReadSensorDataUUID: {0xf2, 0x00, 0x00, 0x79, 0x00, 0x00, 0x00, 0x10, 0x65, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	}}
+	metaData, _, err := ReadMiflora(conn, VersionBatteryResponse{BatteryLevel: 50, FirmwareVersion: "3.1.8"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, VersionBatteryResponse{BatteryLevel: 50, FirmwareVersion: "3.1.8"}, metaData)
+
+	_, _, err = ReadMiflora(conn, VersionBatteryResponse{BatteryLevel: 50, FirmwareVersion: "3.1.8"}, true)
+	assert.Error(t, err)
+
+	// device answers with placeholder e.g. because mode change did not work
+	conn = &fakeConn{values: map[string][]byte{
+		MifloraCharVersionBatteryUUID: {0x64, 0x15, 0x32, 0x2e, 0x37, 0x2e, 0x30},
+		MifloraCharReadSensorDataUUID: MifloraPlaceholderData,
+	}}
+	_, _, err = ReadMiflora(conn, VersionBatteryResponse{}, true)
+	assert.Equal(t, ErrPlaceholderData, errors.Cause(err))
+}
+
+func TestRequestSensorInfo(t *testing.T) {
+	conn := &fakeConn{values: map[string][]byte{
+		CharDeviceNameUUID:            []byte("Flower care"),
+		CharAppearanceUUID:            {0x00, 0x00},
+		MifloraCharVersionBatteryUUID: {0x64, 0x15, 0x33, 0x2e, 0x32, 0x2e, 0x31},
+	}}
+
+	info, err := RequestSensorInfo(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, SensorInfo{DeviceName: "Flower care", Appearance: 0, FirmwareVersion: "3.2.1"}, info)
+
+	delete(conn.values, CharAppearanceUUID)
+	_, err = RequestSensorInfo(conn)
+	assert.Error(t, err)
+}
+
+func TestSubscribeSensorData(t *testing.T) {
+	conn := &fakeConn{}
+
+	results := []SensorDataResponse{}
+	errs := []error{}
+	err := SubscribeSensorData(conn, VersionBatteryResponse{FirmwareVersion: "2.7.0"}, func(sensorData SensorDataResponse, err error) {
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		results = append(results, sensorData)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{MifloraCharModeChangeUUID}, conn.writes)
+
+	handler := conn.handlers[MifloraCharReadSensorDataUUID]
+	handler([]byte{0xf2, 0x00, 0x00, 0x79, 0x00, 0x00, 0x00, 0x10, 0x65, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	handler(MifloraPlaceholderData)
+	assert.Equal(t, []SensorDataResponse{{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101}}, results)
+	assert.Equal(t, []error{ErrPlaceholderData}, errs)
+
+	// older firmware needs no mode change
+	conn = &fakeConn{}
+	err = SubscribeSensorData(conn, VersionBatteryResponse{FirmwareVersion: "2.6.2"}, func(SensorDataResponse, error) {})
+	assert.NoError(t, err)
+	assert.Empty(t, conn.writes)
+	assert.Contains(t, conn.handlers, MifloraCharReadSensorDataUUID)
+}
+
+func TestRequestHistory(t *testing.T) {
+	conn := &fakeConn{
+		values: map[string][]byte{
+			MifloraCharHistoryReadUUID: {0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		history: [][]byte{
+			{0x10, 0x0e, 0x00, 0x00, 0xf2, 0x00, 0x00, 0x79, 0x00, 0x00, 0x00, 0x10, 0x65, 0x00, 0x00, 0x00},
+			MifloraPlaceholderData,
+			{0x20, 0x1c, 0x00, 0x00, 0xce, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x28, 0x0e, 0x01, 0x00, 0x00},
+		},
+	}
+
+	entries, err := RequestHistory(conn, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []HistoryEntryResponse{
+		{DeviceTime: 3600, Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		{DeviceTime: 7200, Temperature: -5.0, Brightness: 0, Moisture: 40, Conductivity: 270},
+	}, entries)
+	assert.Len(t, conn.writes, 4)
+
+	// only entries after the given device time
+	conn.writes = nil
+	entries, err = RequestHistory(conn, 3600)
+	assert.NoError(t, err)
+	assert.Equal(t, []HistoryEntryResponse{
+		{DeviceTime: 7200, Temperature: -5.0, Brightness: 0, Moisture: 40, Conductivity: 270},
+	}, entries)
+}
@@ -1,9 +1,7 @@
 package common
 
 import (
-	"math"
-	"strconv"
-	"strings"
+	"time"
 )
 
 // captures response when reading meta data of miflora device
@@ -20,21 +18,82 @@ type SensorDataResponse struct {
 	Conductivity uint16  // in µS/cm
 }
 
+func (res VersionBatteryResponse) ParsedFirmwareVersion() (FirmwareVersion, error) {
+	return ParseFirmwareVersion(res.FirmwareVersion)
+}
+
 // turns firmware version "2.3.4" into 20304
-func (res VersionBatteryResponse) NumericFirmwareVersion() int {
-	version := 0
-	parts := strings.Split(res.FirmwareVersion, ".")
-	for i, part := range parts {
-		partNumber, err := strconv.Atoi(part)
-		if err != nil {
-			continue
-		}
-		version += int(math.Pow10((len(parts)-(i+1))*2)) * partNumber
+func (res VersionBatteryResponse) NumericFirmwareVersion() (int, error) {
+	version, err := res.ParsedFirmwareVersion()
+	if err != nil {
+		return 0, err
 	}
-	return version
+	return version.Numeric(), nil
+}
+
+// unparsable versions are assumed to be recent and thus have all capabilities
+func (res VersionBatteryResponse) HasCapability(capability FirmwareCapability) bool {
+	version, err := res.ParsedFirmwareVersion()
+	if err != nil {
+		return true
+	}
+	return version.HasCapability(capability)
 }
 
 // for the newer models a magic number must be written before we can read the current data
 func (res VersionBatteryResponse) RequiresModeChangeBeforeRead() bool {
-	return res.FirmwareVersion >= "2.6.6"
+	return res.HasCapability(CapabilityModeChangeBeforeRead)
+}
+
+// captures the identity of miflora device as read from its Generic Access service and meta data
+type SensorInfo struct {
+	DeviceName      string // e.g. "Flower care"
+	Appearance      uint16 // as assigned by Bluetooth SIG, 0 is unknown
+	FirmwareVersion string // as "x.y.z"
+}
+
+// captures response when reading the number of stored history entries of miflora device
+type HistoryCountResponse struct {
+	EntryCount uint16
+}
+
+// captures response when reading a single history entry of miflora device
+type HistoryEntryResponse struct {
+	DeviceTime   uint32  // in seconds since device boot
+	Temperature  float64 // in degree C
+	Brightness   uint32  // in lux
+	Moisture     uint8   // in percent 0-100
+	Conductivity uint16  // in µS/cm
+}
+
+// captures response when reading the device clock of miflora device
+type DeviceTimeResponse struct {
+	DeviceTime uint32    // in seconds since device boot
+	ReadAt     time.Time // local wall clock time when device clock was read
+}
+
+// translates a device time (e.g. of a history entry) into wall clock time
+// using the offset between device clock and local clock
+func (res DeviceTimeResponse) WallTime(deviceTime uint32) time.Time {
+	offset := time.Duration(int64(res.DeviceTime)-int64(deviceTime)) * time.Second
+	return res.ReadAt.Add(-offset)
+}
+
+// translates a wall clock time into device time, 0 if the device was not running yet
+func (res DeviceTimeResponse) DeviceTimeAt(wallTime time.Time) uint32 {
+	elapsed := int64(res.ReadAt.Sub(wallTime) / time.Second)
+	if elapsed >= int64(res.DeviceTime) {
+		return 0
+	}
+	return uint32(int64(res.DeviceTime) - elapsed)
+}
+
+// returns the sensor values of the history entry in the same shape as live sensor data
+func (res HistoryEntryResponse) SensorData() SensorDataResponse {
+	return SensorDataResponse{
+		Temperature:  res.Temperature,
+		Brightness:   res.Brightness,
+		Moisture:     res.Moisture,
+		Conductivity: res.Conductivity,
+	}
 }
@@ -2,6 +2,7 @@ package common
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -10,15 +11,58 @@ func TestNumericFirmwareVersion(t *testing.T) {
 	tables := []struct {
 		metaData VersionBatteryResponse
 		firmware int
+		valid    bool
 	}{
-		{VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "1.0.0"}, 10000},
-		{VersionBatteryResponse{BatteryLevel: 88, FirmwareVersion: "2.6.6"}, 20606},
-		{VersionBatteryResponse{BatteryLevel: 77, FirmwareVersion: "0.1.0"}, 100},
-		{VersionBatteryResponse{BatteryLevel: 66, FirmwareVersion: "1.x.5"}, 10005},
-		{VersionBatteryResponse{BatteryLevel: 55, FirmwareVersion: "fubar"}, 0},
+		{VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "1.0.0"}, 10000, true},
+		{VersionBatteryResponse{BatteryLevel: 88, FirmwareVersion: "2.6.6"}, 20606, true},
+		{VersionBatteryResponse{BatteryLevel: 77, FirmwareVersion: "0.1.0"}, 100, true},
+		{VersionBatteryResponse{BatteryLevel: 66, FirmwareVersion: "1.x.5"}, 0, false},
+		{VersionBatteryResponse{BatteryLevel: 55, FirmwareVersion: "fubar"}, 0, false},
+		{VersionBatteryResponse{BatteryLevel: 44, FirmwareVersion: "2.10.0"}, 21000, true},
+		{VersionBatteryResponse{BatteryLevel: 33, FirmwareVersion: "3.0.0-beta"}, 30000, true},
+		{VersionBatteryResponse{BatteryLevel: 22, FirmwareVersion: ""}, 0, false},
 	}
 
 	for _, table := range tables {
-		assert.Equal(t, table.firmware, table.metaData.NumericFirmwareVersion())
+		firmware, err := table.metaData.NumericFirmwareVersion()
+		assert.Equal(t, table.firmware, firmware, table.metaData.FirmwareVersion)
+		if table.valid {
+			assert.NoError(t, err, table.metaData.FirmwareVersion)
+		} else {
+			assert.Error(t, err, table.metaData.FirmwareVersion)
+		}
+	}
+}
+
+func TestDeviceTimeWallTime(t *testing.T) {
+	deviceTime := DeviceTimeResponse{DeviceTime: 86400, ReadAt: time.Unix(1500000000, 0)}
+
+	assert.Equal(t, time.Unix(1500000000, 0), deviceTime.WallTime(86400))
+	assert.Equal(t, time.Unix(1500000000-3600, 0), deviceTime.WallTime(82800))
+	assert.Equal(t, time.Unix(1500000000-86400, 0), deviceTime.WallTime(0))
+
+	assert.Equal(t, uint32(86400), deviceTime.DeviceTimeAt(time.Unix(1500000000, 0)))
+	assert.Equal(t, uint32(82800), deviceTime.DeviceTimeAt(time.Unix(1500000000-3600, 0)))
+	assert.Equal(t, uint32(0), deviceTime.DeviceTimeAt(time.Unix(1500000000-2*86400, 0)))
+	assert.Equal(t, uint32(0), deviceTime.DeviceTimeAt(time.Time{}))
+}
+
+func TestRequiresModeChangeBeforeRead(t *testing.T) {
+	tables := []struct {
+		firmware   string
+		modeChange bool
+	}{
+		{"2.6.2", false},
+		{"2.6.6", true},
+		{"2.7.0", true},
+		{"2.10.0", true},
+		{"3.0.0-beta", true},
+		{"2.6.6-beta", false},
+		{"fubar", true},
+	}
+
+	for _, table := range tables {
+		metaData := VersionBatteryResponse{FirmwareVersion: table.firmware}
+		assert.Equal(t, table.modeChange, metaData.RequiresModeChangeBeforeRead(), table.firmware)
 	}
 }
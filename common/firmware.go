@@ -0,0 +1,157 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// semantic version of the miflora firmware e.g. "2.7.0" or "3.0.0-beta"
+type FirmwareVersion struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease string // without leading "-", empty for releases
+}
+
+func ParseFirmwareVersion(original string) (FirmwareVersion, error) {
+	version := FirmwareVersion{}
+	s := original
+
+	// build metadata does not take part in ordering
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		version.PreRelease = s[i+1:]
+		s = s[:i]
+		if version.PreRelease == "" {
+			return FirmwareVersion{}, errors.Errorf("invalid firmware version %q: empty pre-release", original)
+		}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return FirmwareVersion{}, errors.Errorf("invalid firmware version %q: expected x.y.z", original)
+	}
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return FirmwareVersion{}, errors.Errorf("invalid firmware version %q: %q is no number", original, part)
+		}
+		numbers[i] = number
+	}
+	version.Major, version.Minor, version.Patch = numbers[0], numbers[1], numbers[2]
+
+	return version, nil
+}
+
+func MustParseFirmwareVersion(s string) FirmwareVersion {
+	version, err := ParseFirmwareVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return version
+}
+
+func (v FirmwareVersion) String() string {
+	if v.PreRelease != "" {
+		return fmt.Sprintf("%d.%d.%d-%s", v.Major, v.Minor, v.Patch, v.PreRelease)
+	}
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// returns -1, 0 or 1 if v is lower, equal or greater than other following https://semver.org/#spec-item-11
+func (v FirmwareVersion) Compare(other FirmwareVersion) int {
+	if c := compareInts(v.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+	return comparePreReleases(v.PreRelease, other.PreRelease)
+}
+
+func (v FirmwareVersion) AtLeast(other FirmwareVersion) bool {
+	return v.Compare(other) >= 0
+}
+
+// turns firmware version "2.3.4" into 20304
+func (v FirmwareVersion) Numeric() int {
+	return v.Major*10000 + v.Minor*100 + v.Patch
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func comparePreReleases(a, b string) int {
+	// a release has higher precedence than any of its pre-releases
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			c = compareInts(an, bn)
+		case aErr == nil:
+			// numeric identifiers have lower precedence than alphanumeric ones
+			c = -1
+		case bErr == nil:
+			c = 1
+		default:
+			c = strings.Compare(as[i], bs[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(as), len(bs))
+}
+
+// behavior of the device that depends on the firmware version
+type FirmwareCapability int
+
+const (
+	// a magic number must be written before the current sensor data can be read
+	CapabilityModeChangeBeforeRead FirmwareCapability = iota
+	// hourly history entries can be read from the history service
+	CapabilityHistory
+	// MiBeacon advertisements may be encrypted with a bind key
+	CapabilityEncryptedBeacons
+)
+
+// minimum firmware version that has a capability
+var firmwareCapabilities = map[FirmwareCapability]FirmwareVersion{
+	// Source: https://github.com/open-homeautomation/miflora/blob/master/miflora/miflora_poller.py
+	CapabilityModeChangeBeforeRead: {Major: 2, Minor: 6, Patch: 6},
+	CapabilityHistory:              {Major: 2, Minor: 6, Patch: 6},
+	CapabilityEncryptedBeacons:     {Major: 3, Minor: 3, Patch: 5},
+}
+
+func (v FirmwareVersion) HasCapability(capability FirmwareCapability) bool {
+	since, ok := firmwareCapabilities[capability]
+	return ok && v.AtLeast(since)
+}
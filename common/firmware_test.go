@@ -0,0 +1,61 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFirmwareVersion(t *testing.T) {
+	tables := []struct {
+		s       string
+		version FirmwareVersion
+	}{
+		{"2.7.0", FirmwareVersion{Major: 2, Minor: 7, Patch: 0}},
+		{"2.10.0", FirmwareVersion{Major: 2, Minor: 10, Patch: 0}},
+		{"3.0.0-beta", FirmwareVersion{Major: 3, Minor: 0, Patch: 0, PreRelease: "beta"}},
+		{"3.0.0-rc.1+build.5", FirmwareVersion{Major: 3, Minor: 0, Patch: 0, PreRelease: "rc.1"}},
+	}
+
+	for _, table := range tables {
+		version, err := ParseFirmwareVersion(table.s)
+		assert.NoError(t, err)
+		assert.Equal(t, table.version, version)
+	}
+
+	for _, s := range []string{"", "fubar", "1.x.5", "2.7", "2.7.0.1", "2.7.0-", "-1.0.0"} {
+		_, err := ParseFirmwareVersion(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestFirmwareVersionString(t *testing.T) {
+	assert.Equal(t, "2.7.0", MustParseFirmwareVersion("2.7.0").String())
+	assert.Equal(t, "3.0.0-beta", MustParseFirmwareVersion("3.0.0-beta").String())
+}
+
+func TestFirmwareVersionCompare(t *testing.T) {
+	// in ascending order
+	versions := []string{
+		"1.0.0", "2.6.2", "2.6.6", "2.7.0", "2.9.9", "2.10.0",
+		"3.0.0-alpha", "3.0.0-alpha.1", "3.0.0-alpha.beta", "3.0.0-beta", "3.0.0-beta.2", "3.0.0-beta.11", "3.0.0-rc.1", "3.0.0",
+	}
+
+	for i := range versions {
+		for j := range versions {
+			a, b := MustParseFirmwareVersion(versions[i]), MustParseFirmwareVersion(versions[j])
+			expected := compareInts(i, j)
+			assert.Equal(t, expected, a.Compare(b), "%s vs. %s", versions[i], versions[j])
+			assert.Equal(t, expected >= 0, a.AtLeast(b), "%s vs. %s", versions[i], versions[j])
+		}
+	}
+}
+
+func TestFirmwareVersionHasCapability(t *testing.T) {
+	assert.False(t, MustParseFirmwareVersion("2.6.2").HasCapability(CapabilityModeChangeBeforeRead))
+	assert.True(t, MustParseFirmwareVersion("2.6.6").HasCapability(CapabilityModeChangeBeforeRead))
+	assert.True(t, MustParseFirmwareVersion("2.10.0").HasCapability(CapabilityHistory))
+	assert.False(t, MustParseFirmwareVersion("3.1.8").HasCapability(CapabilityEncryptedBeacons))
+	assert.True(t, MustParseFirmwareVersion("3.3.5").HasCapability(CapabilityEncryptedBeacons))
+	assert.False(t, MustParseFirmwareVersion("3.3.5").HasCapability(FirmwareCapability(-1)))
+}
@@ -1,13 +1,22 @@
 package gatt
 
 import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
 	"miflorad/common"
 
 	"github.com/currantlabs/gatt"
+	"github.com/currantlabs/gatt/examples/option"
 	"github.com/pkg/errors"
 )
 
-var MifloraCharVersionBatteryUUID = gatt.MustParseUUID("00001a02-0000-1000-8000-00805f9b34fb")
+const (
+	powerOnTimeout    = 5 * time.Second
+	disconnectTimeout = 2 * time.Second
+)
 
 func FindServiceByUUID(services []*gatt.Service, u gatt.UUID) *gatt.Service {
 	for _, service := range services {
@@ -27,59 +36,266 @@ func FindCharacteristicByUUID(characteristics []*gatt.Characteristic, u gatt.UUI
 	return nil
 }
 
-func MifloraRequestVersionBattery(p gatt.Peripheral) (common.VersionBatteryResponse, error) {
-	mifloraService := FindServiceByUUID(p.Services(), gatt.MustParseUUID(common.MifloraServiceUUID))
-	if mifloraService == nil {
-		return common.VersionBatteryResponse{}, errors.New("Failed to get the miflora service")
+type discoveryResult struct {
+	p    gatt.Peripheral
+	rssi int
+}
+
+type connectionResult struct {
+	p   gatt.Peripheral
+	err error
+}
+
+var _ common.MifloraBackend = (*Backend)(nil)
+
+// implements common.MifloraBackend using github.com/currantlabs/gatt
+// which reports discoveries and connections via callbacks only
+type Backend struct {
+	device    gatt.Device
+	poweredOn chan struct{}
+
+	// guards the fields below which are accessed from the callbacks
+	lock           sync.Mutex
+	wantedID       string
+	discoveryDone  chan discoveryResult
+	connectionDone chan connectionResult
+	connections    map[string]*conn
+}
+
+func NewBackend() (*Backend, error) {
+	device, err := gatt.NewDevice(option.DefaultClientOptions...)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open device")
 	}
 
-	mifloraVersionBatteryChar := FindCharacteristicByUUID(mifloraService.Characteristics(), MifloraCharVersionBatteryUUID)
-	if mifloraVersionBatteryChar == nil {
-		return common.VersionBatteryResponse{}, errors.New("Failed to get the version battery characteristic")
+	b := &Backend{
+		device:      device,
+		poweredOn:   make(chan struct{}, 1),
+		connections: map[string]*conn{},
 	}
 
-	bytes, err := p.ReadCharacteristic(mifloraVersionBatteryChar)
-	if err != nil {
-		return common.VersionBatteryResponse{}, errors.Wrap(err, "can't read version battery")
+	device.Handle(
+		gatt.PeripheralDiscovered(b.onPeriphDiscovered),
+		gatt.PeripheralConnected(b.onPeriphConnected),
+		gatt.PeripheralDisconnected(b.onPeriphDisconnected),
+	)
+
+	if err := device.Init(b.onStateChanged); err != nil {
+		return nil, errors.Wrap(err, "can't init device")
+	}
+
+	select {
+	case <-b.poweredOn:
+	case <-time.After(powerOnTimeout):
+		return nil, errors.New("Device did not power on")
+	}
+
+	return b, nil
+}
+
+func (b *Backend) onStateChanged(device gatt.Device, state gatt.State) {
+	switch state {
+	case gatt.StatePoweredOn:
+		select {
+		case b.poweredOn <- struct{}{}:
+		default:
+		}
+	default:
+		device.StopScanning()
+	}
+}
+
+func (b *Backend) onPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.discoveryDone == nil || !strings.EqualFold(p.ID(), b.wantedID) {
+		return
 	}
 
-	return common.ParseVersionBattery(bytes), nil
+	// Stop scanning once we've got the peripheral we're looking for.
+	p.Device().StopScanning()
+
+	b.discoveryDone <- discoveryResult{p, rssi}
+	b.discoveryDone = nil
 }
 
-func MifloraRequestModeChange(p gatt.Peripheral) error {
-	mifloraService := FindServiceByUUID(p.Services(), gatt.MustParseUUID(common.MifloraServiceUUID))
-	if mifloraService == nil {
-		return errors.New("Failed to get the miflora service")
+func (b *Backend) onPeriphConnected(p gatt.Peripheral, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.connectionDone == nil {
+		return
 	}
 
-	mifloraModeChangeChar := FindCharacteristicByUUID(mifloraService.Characteristics(), gatt.MustParseUUID(common.MifloraCharModeChangeUUID))
-	if mifloraModeChangeChar == nil {
-		return errors.New("Failed to discover the mode change characteristic")
+	b.connectionDone <- connectionResult{p, err}
+	b.connectionDone = nil
+}
+
+func (b *Backend) onPeriphDisconnected(p gatt.Peripheral, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c, ok := b.connections[p.ID()]; ok {
+		delete(b.connections, p.ID())
+		c.disconnected()
 	}
+}
+
+func (b *Backend) Connect(ctx context.Context, peripheralID string) (common.MifloraConn, error) {
+	discoveryDone := make(chan discoveryResult, 1)
+	connectionDone := make(chan connectionResult, 1)
+
+	b.lock.Lock()
+	b.wantedID = peripheralID
+	b.discoveryDone = discoveryDone
+	b.connectionDone = connectionDone
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		b.discoveryDone = nil
+		b.connectionDone = nil
+		b.lock.Unlock()
+	}()
+
+	b.device.Scan([]gatt.UUID{}, false)
 
-	err := p.WriteCharacteristic(mifloraModeChangeChar, common.MifloraGetModeChangeData(), false)
+	var discovery discoveryResult
+	select {
+	case discovery = <-discoveryDone:
+	case <-ctx.Done():
+		b.device.StopScanning()
+		return nil, errors.Wrapf(ctx.Err(), "can't discover %s", peripheralID)
+	}
+
+	b.device.Connect(discovery.p)
+
+	var connection connectionResult
+	select {
+	case connection = <-connectionDone:
+		if connection.err != nil {
+			return nil, errors.Wrapf(connection.err, "can't connect to %s", peripheralID)
+		}
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "can't connect to %s", peripheralID)
+	}
+
+	c := &conn{p: connection.p, rssi: discovery.rssi, done: make(chan struct{})}
+
+	b.lock.Lock()
+	b.connections[c.p.ID()] = c
+	b.lock.Unlock()
+
+	// a failure here is not fatal, reads will just be split into more packets
+	_ = c.p.SetMTU(500)
+
+	services, err := c.p.DiscoverServices([]gatt.UUID{
+		gatt.MustParseUUID(common.GenericAccessServiceUUID),
+		gatt.MustParseUUID(common.MifloraServiceUUID),
+		gatt.MustParseUUID(common.MifloraHistoryServiceUUID),
+	})
 	if err != nil {
-		return errors.Wrap(err, "can't change mode")
+		c.Close()
+		return nil, &common.ProfileDiscoveryError{Err: errors.Wrap(err, "can't discover services")}
+	}
+	for _, service := range services {
+		if _, err := c.p.DiscoverCharacteristics(nil, service); err != nil {
+			c.Close()
+			return nil, &common.ProfileDiscoveryError{Err: errors.Wrap(err, "can't discover characteristics")}
+		}
 	}
 
-	return nil
+	return c, nil
 }
 
-func MifloraRequstSensorData(p gatt.Peripheral) (common.SensorDataResponse, error) {
-	mifloraService := FindServiceByUUID(p.Services(), gatt.MustParseUUID(common.MifloraServiceUUID))
-	if mifloraService == nil {
-		return common.SensorDataResponse{}, errors.New("Failed to get the miflora service")
+func (b *Backend) Stop() error {
+	return b.device.Stop()
+}
+
+var _ common.MifloraConn = (*conn)(nil)
+
+// implements common.MifloraConn for a connected gatt.Peripheral
+type conn struct {
+	p    gatt.Peripheral
+	rssi int
+	// closed once disconnected by either side
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (c *conn) disconnected() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+func (c *conn) findCharacteristic(uuid string) (*gatt.Characteristic, error) {
+	u := gatt.MustParseUUID(uuid)
+	for _, service := range c.p.Services() {
+		if characteristic := FindCharacteristicByUUID(service.Characteristics(), u); characteristic != nil {
+			return characteristic, nil
+		}
 	}
+	return nil, &common.ProfileDiscoveryError{Err: errors.Errorf("Failed to discover the characteristic %s", uuid)}
+}
 
-	mifloraSensorDataChar := FindCharacteristicByUUID(mifloraService.Characteristics(), gatt.MustParseUUID(common.MifloraCharReadSensorDataUUID))
-	if mifloraSensorDataChar == nil {
-		return common.SensorDataResponse{}, errors.New("Failed to discover the sensor data characteristic")
+func (c *conn) ReadCharacteristic(uuid string) ([]byte, error) {
+	characteristic, err := c.findCharacteristic(uuid)
+	if err != nil {
+		return nil, err
 	}
 
-	bytes, err := p.ReadCharacteristic(mifloraSensorDataChar)
+	return c.p.ReadCharacteristic(characteristic)
+}
+
+func (c *conn) WriteCharacteristic(uuid string, data []byte) error {
+	characteristic, err := c.findCharacteristic(uuid)
 	if err != nil {
-		return common.SensorDataResponse{}, errors.Wrap(err, "can't read sensor data")
+		return err
+	}
+
+	return c.p.WriteCharacteristic(characteristic, data, false)
+}
+
+func (c *conn) SubscribeCharacteristic(uuid string, handler func(data []byte)) error {
+	characteristic, err := c.findCharacteristic(uuid)
+	if err != nil {
+		return err
+	}
+
+	// the client characteristic configuration descriptor is needed for enabling notifications
+	if _, err := c.p.DiscoverDescriptors(nil, characteristic); err != nil {
+		return errors.Wrap(err, "can't discover descriptors")
 	}
 
-	return common.ParseSensorData(bytes), nil
+	return c.p.SetNotifyValue(characteristic, func(_ *gatt.Characteristic, data []byte, err error) {
+		if err == nil {
+			handler(data)
+		}
+	})
+}
+
+func (c *conn) RSSI() int {
+	return c.rssi
+}
+
+func (c *conn) Disconnected() <-chan struct{} {
+	return c.done
+}
+
+func (c *conn) Close() error {
+	// Note: can hang when the device has terminated the connection on it's own already,
+	// in that case the kernel will cleanup after our process finishes
+	done := make(chan struct{})
+	go func() {
+		c.p.Device().CancelConnection(c.p)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		c.disconnected()
+		return nil
+	case <-time.After(disconnectTimeout):
+		return errors.New("Disconnecting timed out")
+	}
 }
@@ -0,0 +1,258 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Source: https://github.com/custom-components/ble_monitor/blob/master/custom_components/ble_monitor/ble_parser/xiaomi.py
+const (
+	MiBeaconServiceUUID   = "0000fe95-0000-1000-8000-00805f9b34fb"
+	MiBeaconServiceUUID16 = 0xfe95
+
+	MiBeaconProductIDFlora = 0x0098
+	MiBeaconBindKeySize    = 16
+
+	miBeaconFrameControlEncrypted      = 0x0008
+	miBeaconFrameControlMacIncluded    = 0x0010
+	miBeaconFrameControlCapIncluded    = 0x0020
+	miBeaconFrameControlObjectIncluded = 0x0040
+	miBeaconCapabilityIO               = 0x20
+
+	MiBeaconObjectTemperature  = 0x1004
+	MiBeaconObjectBrightness   = 0x1007
+	MiBeaconObjectMoisture     = 0x1008
+	MiBeaconObjectConductivity = 0x1009
+	MiBeaconObjectBattery      = 0x100a
+)
+
+var ErrMiBeaconEncrypted = errors.New("MiBeacon frame is encrypted but no bind key given")
+
+// captures a single object (i.e. measurement) contained in a MiBeacon frame
+type MiBeaconObject struct {
+	Type uint16
+	Data []byte
+}
+
+// captures a MiBeacon frame broadcast as service data of a miflora device advertisement
+type MiBeaconResponse struct {
+	FrameControl uint16
+	ProductID    uint16
+	FrameCounter uint8
+	MacAddress   string // as "c4:7c:8d:xx:xx:xx", empty if not included in frame
+	Objects      []MiBeaconObject
+}
+
+// returns the MiBeacon version encoded in the frame control
+func (res MiBeaconResponse) Version() int {
+	return int(res.FrameControl >> 12)
+}
+
+func (res MiBeaconResponse) IsEncrypted() bool {
+	return res.FrameControl&miBeaconFrameControlEncrypted != 0
+}
+
+func ParseMiBeacon(bytes []byte) (MiBeaconResponse, error) {
+	return ParseMiBeaconWithKey(bytes, "", nil)
+}
+
+// parses a MiBeacon frame decrypting the objects of v4/v5 frames with the given bind key,
+// the MAC address (as "c4:7c:8d:xx:xx:xx") is only needed if the frame does not include it
+func ParseMiBeaconWithKey(bytes []byte, macAddress string, bindKey []byte) (MiBeaconResponse, error) {
+	if len(bytes) < 5 {
+		return MiBeaconResponse{}, errors.Errorf("MiBeacon frame too short (%d bytes)", len(bytes))
+	}
+
+	res := MiBeaconResponse{
+		FrameControl: binary.LittleEndian.Uint16(bytes[0:2]),
+		ProductID:    binary.LittleEndian.Uint16(bytes[2:4]),
+		FrameCounter: uint8(bytes[4]),
+	}
+	i := 5
+
+	var mac []byte
+	if res.FrameControl&miBeaconFrameControlMacIncluded != 0 {
+		if len(bytes) < i+6 {
+			return MiBeaconResponse{}, errors.New("MiBeacon frame too short for MAC address")
+		}
+		mac = bytes[i : i+6]
+		res.MacAddress = fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", mac[5], mac[4], mac[3], mac[2], mac[1], mac[0])
+		i += 6
+	}
+
+	if res.FrameControl&miBeaconFrameControlCapIncluded != 0 {
+		if len(bytes) < i+1 {
+			return MiBeaconResponse{}, errors.New("MiBeacon frame too short for capability")
+		}
+		capability := bytes[i]
+		i++
+		if capability&miBeaconCapabilityIO != 0 {
+			i += 2
+		}
+	}
+
+	if res.FrameControl&miBeaconFrameControlObjectIncluded == 0 {
+		return res, nil
+	}
+
+	if len(bytes) < i {
+		return MiBeaconResponse{}, errors.New("MiBeacon frame too short for objects")
+	}
+
+	payload := bytes[i:]
+	if res.IsEncrypted() {
+		if len(bindKey) == 0 {
+			return MiBeaconResponse{}, ErrMiBeaconEncrypted
+		}
+		var err error
+		if mac == nil {
+			if mac, err = parseMiBeaconMacAddress(macAddress); err != nil {
+				return MiBeaconResponse{}, err
+			}
+		}
+		if payload, err = decryptMiBeaconPayload(bytes[2:5], mac, payload, res.Version(), bindKey); err != nil {
+			return MiBeaconResponse{}, err
+		}
+	}
+
+	objects, err := parseMiBeaconObjects(payload)
+	if err != nil {
+		return MiBeaconResponse{}, err
+	}
+	res.Objects = objects
+
+	return res, nil
+}
+
+// turns "c4:7c:8d:66:d5:27" into the byte order used within MiBeacon frames
+func parseMiBeaconMacAddress(macAddress string) ([]byte, error) {
+	mac, err := hex.DecodeString(strings.ReplaceAll(macAddress, ":", ""))
+	if err != nil || len(mac) != 6 {
+		return nil, errors.Errorf("invalid MAC address %q", macAddress)
+	}
+	for i, j := 0, len(mac)-1; i < j; i, j = i+1, j-1 {
+		mac[i], mac[j] = mac[j], mac[i]
+	}
+	return mac, nil
+}
+
+// Source: https://github.com/custom-components/ble_monitor/blob/master/custom_components/ble_monitor/ble_parser/xiaomi.py
+func decryptMiBeaconPayload(productIDAndCounter, mac, payload []byte, version int, bindKey []byte) ([]byte, error) {
+	if version < 4 {
+		return nil, errors.Errorf("MiBeacon v%d encryption is not supported", version)
+	}
+	if len(bindKey) != MiBeaconBindKeySize {
+		return nil, errors.Errorf("MiBeacon bind key must be %d bytes", MiBeaconBindKeySize)
+	}
+	// encrypted objects are followed by 3 bytes extended frame counter and 4 bytes tag
+	if len(payload) < 3+7 {
+		return nil, errors.New("MiBeacon frame too short for encrypted objects")
+	}
+
+	ciphertext := payload[:len(payload)-7]
+	extendedCounter := payload[len(payload)-7 : len(payload)-4]
+	tag := payload[len(payload)-4:]
+
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, mac...)
+	nonce = append(nonce, productIDAndCounter...)
+	nonce = append(nonce, extendedCounter...)
+
+	plaintext, err := aesCCMOpen(bindKey, nonce, ciphertext, tag, []byte{0x11})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decrypt MiBeacon frame")
+	}
+	return plaintext, nil
+}
+
+// parses a bind key given as 32 hex characters
+func ParseMiBeaconBindKey(s string) ([]byte, error) {
+	bindKey, err := hex.DecodeString(s)
+	if err != nil || len(bindKey) != MiBeaconBindKeySize {
+		return nil, errors.Errorf("invalid MiBeacon bind key %q, must be %d hex characters", s, 2*MiBeaconBindKeySize)
+	}
+	return bindKey, nil
+}
+
+func parseMiBeaconObjects(bytes []byte) ([]MiBeaconObject, error) {
+	objects := []MiBeaconObject{}
+	for i := 0; i < len(bytes); {
+		if len(bytes) < i+3 {
+			return nil, errors.New("MiBeacon object header truncated")
+		}
+		objectType := binary.LittleEndian.Uint16(bytes[i : i+2])
+		objectLength := int(bytes[i+2])
+		i += 3
+		if len(bytes) < i+objectLength {
+			return nil, errors.Errorf("MiBeacon object 0x%04x truncated", objectType)
+		}
+		objects = append(objects, MiBeaconObject{Type: objectType, Data: bytes[i : i+objectLength]})
+		i += objectLength
+	}
+	return objects, nil
+}
+
+const (
+	MiBeaconHasTemperature = 1 << iota
+	MiBeaconHasBrightness
+	MiBeaconHasMoisture
+	MiBeaconHasConductivity
+	MiBeaconHasBattery
+
+	MiBeaconHasSensorData = MiBeaconHasTemperature | MiBeaconHasBrightness | MiBeaconHasMoisture | MiBeaconHasConductivity
+)
+
+// accumulates the values of a miflora device which broadcasts only one MiBeacon object per frame
+type MiBeaconSensorState struct {
+	SensorData   SensorDataResponse
+	BatteryLevel uint8 // in percent 0-100
+	Received     int   // bit mask of MiBeaconHas* for values received so far
+}
+
+func (state *MiBeaconSensorState) Update(object MiBeaconObject) error {
+	switch object.Type {
+	case MiBeaconObjectTemperature:
+		if len(object.Data) < 2 {
+			return errors.New("MiBeacon temperature object too short")
+		}
+		state.SensorData.Temperature = float64(int16(binary.LittleEndian.Uint16(object.Data[0:2]))) / 10.0
+		state.Received |= MiBeaconHasTemperature
+	case MiBeaconObjectBrightness:
+		if len(object.Data) < 3 {
+			return errors.New("MiBeacon brightness object too short")
+		}
+		state.SensorData.Brightness = uint32(object.Data[0]) | uint32(object.Data[1])<<8 | uint32(object.Data[2])<<16
+		state.Received |= MiBeaconHasBrightness
+	case MiBeaconObjectMoisture:
+		if len(object.Data) < 1 {
+			return errors.New("MiBeacon moisture object too short")
+		}
+		state.SensorData.Moisture = uint8(object.Data[0])
+		state.Received |= MiBeaconHasMoisture
+	case MiBeaconObjectConductivity:
+		if len(object.Data) < 2 {
+			return errors.New("MiBeacon conductivity object too short")
+		}
+		state.SensorData.Conductivity = binary.LittleEndian.Uint16(object.Data[0:2])
+		state.Received |= MiBeaconHasConductivity
+	case MiBeaconObjectBattery:
+		if len(object.Data) < 1 {
+			return errors.New("MiBeacon battery object too short")
+		}
+		state.BatteryLevel = uint8(object.Data[0])
+		state.Received |= MiBeaconHasBattery
+	}
+	return nil
+}
+
+func (state MiBeaconSensorState) HasSensorData() bool {
+	return state.Received&MiBeaconHasSensorData == MiBeaconHasSensorData
+}
+
+func (state MiBeaconSensorState) HasBattery() bool {
+	return state.Received&MiBeaconHasBattery != 0
+}
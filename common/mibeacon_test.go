@@ -0,0 +1,151 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMiBeacon(t *testing.T) {
+	tables := []struct {
+		bytes    []byte
+		miBeacon MiBeaconResponse
+	}{
+		{
+			[]byte{0x71, 0x20, 0x98, 0x00, 0x12, 0x27, 0xd5, 0x66, 0x8d, 0x7c, 0xc4, 0x0d, 0x04, 0x10, 0x02, 0xf2, 0x00},
+			MiBeaconResponse{
+				FrameControl: 0x2071, ProductID: 0x0098, FrameCounter: 0x12, MacAddress: "c4:7c:8d:66:d5:27",
+				Objects: []MiBeaconObject{{Type: MiBeaconObjectTemperature, Data: []byte{0xf2, 0x00}}},
+			},
+		},
+		{
+			[]byte{0x71, 0x20, 0x98, 0x00, 0x13, 0x27, 0xd5, 0x66, 0x8d, 0x7c, 0xc4, 0x0d, 0x07, 0x10, 0x03, 0xf7, 0x26, 0x00},
+			MiBeaconResponse{
+				FrameControl: 0x2071, ProductID: 0x0098, FrameCounter: 0x13, MacAddress: "c4:7c:8d:66:d5:27",
+				Objects: []MiBeaconObject{{Type: MiBeaconObjectBrightness, Data: []byte{0xf7, 0x26, 0x00}}},
+			},
+		},
+		{
+			[]byte{0x41, 0x20, 0x98, 0x00, 0x14, 0x08, 0x10, 0x01, 0x10, 0x09, 0x10, 0x02, 0x65, 0x00},
+			MiBeaconResponse{
+				FrameControl: 0x2041, ProductID: 0x0098, FrameCounter: 0x14,
+				Objects: []MiBeaconObject{
+					{Type: MiBeaconObjectMoisture, Data: []byte{0x10}},
+					{Type: MiBeaconObjectConductivity, Data: []byte{0x65, 0x00}},
+				},
+			},
+		},
+		{
+			[]byte{0x31, 0x20, 0x98, 0x00, 0x15, 0x27, 0xd5, 0x66, 0x8d, 0x7c, 0xc4, 0x09},
+			MiBeaconResponse{FrameControl: 0x2031, ProductID: 0x0098, FrameCounter: 0x15, MacAddress: "c4:7c:8d:66:d5:27"},
+		},
+	}
+
+	for _, table := range tables {
+		miBeacon, err := ParseMiBeacon(table.bytes)
+		assert.NoError(t, err)
+		assert.Equal(t, table.miBeacon, miBeacon)
+		assert.Equal(t, 2, miBeacon.Version())
+		assert.False(t, miBeacon.IsEncrypted())
+	}
+}
+
+func TestParseMiBeaconInvalid(t *testing.T) {
+	tables := [][]byte{
+		{},
+		{0x71, 0x20, 0x98, 0x00},
+		{0x71, 0x20, 0x98, 0x00, 0x12, 0x27, 0xd5},
+		{0x41, 0x20, 0x98, 0x00, 0x14, 0x08, 0x10},
+		{0x41, 0x20, 0x98, 0x00, 0x14, 0x09, 0x10, 0x02, 0x65},
+		{0x58, 0x30, 0x98, 0x00, 0x14, 0xaa, 0xbb, 0xcc},
+	}
+
+	for _, table := range tables {
+		_, err := ParseMiBeacon(table)
+		assert.Error(t, err)
+	}
+}
+
+func TestMiBeaconSensorState(t *testing.T) {
+	state := MiBeaconSensorState{}
+	assert.False(t, state.HasSensorData())
+
+	assert.NoError(t, state.Update(MiBeaconObject{Type: MiBeaconObjectTemperature, Data: []byte{0xce, 0xff}}))
+	assert.NoError(t, state.Update(MiBeaconObject{Type: MiBeaconObjectBrightness, Data: []byte{0xf7, 0x26, 0x00}}))
+	assert.NoError(t, state.Update(MiBeaconObject{Type: MiBeaconObjectMoisture, Data: []byte{0x28}}))
+	assert.False(t, state.HasSensorData())
+	assert.NoError(t, state.Update(MiBeaconObject{Type: MiBeaconObjectConductivity, Data: []byte{0x0e, 0x01}}))
+	assert.True(t, state.HasSensorData())
+	assert.False(t, state.HasBattery())
+	assert.NoError(t, state.Update(MiBeaconObject{Type: MiBeaconObjectBattery, Data: []byte{0x5f}}))
+	assert.True(t, state.HasBattery())
+
+	assert.Equal(t, SensorDataResponse{Temperature: -5.0, Brightness: 9975, Moisture: 40, Conductivity: 270}, state.SensorData)
+	assert.Equal(t, uint8(95), state.BatteryLevel)
+
+	assert.Error(t, state.Update(MiBeaconObject{Type: MiBeaconObjectBrightness, Data: []byte{0xf7}}))
+}
+
+func TestParseMiBeaconWithKey(t *testing.T) {
+	bindKey := mustDecodeHex("b853075158487ca39a5b5ea9d5b8ef4c")
+
+	tables := []struct {
+		bytes      []byte
+		macAddress string
+		miBeacon   MiBeaconResponse
+	}{
+		// MAC address included in frame
+		{
+			mustDecodeHex("58599800a527d5668d7cc442861c8b7a000000403acaa3"),
+			"",
+			MiBeaconResponse{
+				FrameControl: 0x5958, ProductID: 0x0098, FrameCounter: 0xa5, MacAddress: "c4:7c:8d:66:d5:27",
+				Objects: []MiBeaconObject{{Type: MiBeaconObjectTemperature, Data: []byte{0xf2, 0x00}}},
+			},
+		},
+		// MAC address taken from advertisement
+		{
+			mustDecodeHex("48599800a6abc868199e010000d94f38aa"),
+			"C4:7C:8D:66:D5:27",
+			MiBeaconResponse{
+				FrameControl: 0x5948, ProductID: 0x0098, FrameCounter: 0xa6,
+				Objects: []MiBeaconObject{{Type: MiBeaconObjectConductivity, Data: []byte{0x65, 0x00}}},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		miBeacon, err := ParseMiBeaconWithKey(table.bytes, table.macAddress, bindKey)
+		assert.NoError(t, err)
+		assert.Equal(t, table.miBeacon, miBeacon)
+		assert.Equal(t, 5, miBeacon.Version())
+		assert.True(t, miBeacon.IsEncrypted())
+
+		_, err = ParseMiBeacon(table.bytes)
+		assert.Equal(t, ErrMiBeaconEncrypted, err)
+
+		wrongKey := mustDecodeHex("00000000000000000000000000000000")
+		_, err = ParseMiBeaconWithKey(table.bytes, "c4:7c:8d:66:d5:27", wrongKey)
+		assert.Error(t, err)
+
+		tampered := append([]byte{}, table.bytes...)
+		tampered[len(tampered)-8] ^= 0x01
+		_, err = ParseMiBeaconWithKey(tampered, "c4:7c:8d:66:d5:27", bindKey)
+		assert.Error(t, err)
+	}
+
+	// MAC address neither in frame nor given
+	_, err := ParseMiBeaconWithKey(mustDecodeHex("48599800a6abc868199e010000d94f38aa"), "", bindKey)
+	assert.Error(t, err)
+}
+
+func TestParseMiBeaconBindKey(t *testing.T) {
+	bindKey, err := ParseMiBeaconBindKey("b853075158487ca39a5b5ea9d5b8ef4c")
+	assert.NoError(t, err)
+	assert.Equal(t, mustDecodeHex("b853075158487ca39a5b5ea9d5b8ef4c"), bindKey)
+
+	_, err = ParseMiBeaconBindKey("b853075158487ca3")
+	assert.Error(t, err)
+	_, err = ParseMiBeaconBindKey("x853075158487ca39a5b5ea9d5b8ef4c")
+	assert.Error(t, err)
+}
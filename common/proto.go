@@ -2,6 +2,12 @@ package common
 
 import (
 	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -9,24 +15,165 @@ const (
 	MifloraCharModeChangeUUID     = "00001a00-0000-1000-8000-00805f9b34fb"
 	MifloraCharReadSensorDataUUID = "00001a01-0000-1000-8000-00805f9b34fb"
 	MifloraCharVersionBatteryUUID = "00001a02-0000-1000-8000-00805f9b34fb"
+
+	GenericAccessServiceUUID = "00001800-0000-1000-8000-00805f9b34fb"
+	CharDeviceNameUUID       = "00002a00-0000-1000-8000-00805f9b34fb"
+	CharAppearanceUUID       = "00002a01-0000-1000-8000-00805f9b34fb"
+
+	MifloraHistoryServiceUUID        = "00001206-0000-1000-8000-00805f9b34fb"
+	MifloraCharHistoryControlUUID    = "00001a10-0000-1000-8000-00805f9b34fb"
+	MifloraCharHistoryReadUUID       = "00001a11-0000-1000-8000-00805f9b34fb"
+	MifloraCharHistoryDeviceTimeUUID = "00001a12-0000-1000-8000-00805f9b34fb"
 )
 
 func MifloraGetModeChangeData() []byte {
 	return []byte{0xa0, 0x1f}
 }
 
-func ParseVersionBattery(bytes []byte) VersionBatteryResponse {
+// makes the device flash its LED when written to the mode change characteristic
+func MifloraGetBlinkData() []byte {
+	return []byte{0xfd, 0xff}
+}
+
+// switches the history read characteristic to report the number of history entries
+func MifloraGetHistoryInitData() []byte {
+	return []byte{0xa0, 0x00, 0x00}
+}
+
+// switches the history read characteristic to report the history entry with given index
+func MifloraGetHistoryEntryAddressData(index uint16) []byte {
+	data := []byte{0xa1, 0x00, 0x00}
+	binary.LittleEndian.PutUint16(data[1:3], index)
+	return data
+}
+
+// returned by parsers if a payload is shorter than required
+type ShortPayloadError struct {
+	Payload  string // what was being parsed e.g. "sensor data"
+	Expected int    // minimum number of bytes required
+	Actual   int
+}
+
+func (e *ShortPayloadError) Error() string {
+	return fmt.Sprintf("%s payload too short, expected at least %d bytes but got %d", e.Payload, e.Expected, e.Actual)
+}
+
+// returned by ParseVersionBattery if the firmware version is no printable ASCII string
+type InvalidFirmwareVersionError struct {
+	FirmwareVersion []byte
+}
+
+func (e *InvalidFirmwareVersionError) Error() string {
+	return fmt.Sprintf("firmware version %x contains non-ASCII characters", e.FirmwareVersion)
+}
+
+// returned by parsers if the device answered with the placeholder pattern instead of real data,
+// e.g. when reading sensor data without a preceding mode change
+var ErrPlaceholderData = errors.New("got placeholder instead of real data")
+
+// what the device answers instead of real data
+// Source: https://github.com/open-homeautomation/miflora/blob/master/miflora/miflora_poller.py
+var MifloraPlaceholderData = []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x99, 0x88, 0x77, 0x66, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+func checkPayloadLength(payload string, bytes []byte, expected int) error {
+	if len(bytes) < expected {
+		return &ShortPayloadError{Payload: payload, Expected: expected, Actual: len(bytes)}
+	}
+	return nil
+}
+
+func isPlaceholderData(bytes []byte) bool {
+	// the trailing zeros are not significant
+	return len(bytes) >= 10 && string(bytes[0:10]) == string(MifloraPlaceholderData[0:10])
+}
+
+func ParseVersionBattery(bytes []byte) (VersionBatteryResponse, error) {
+	if err := checkPayloadLength("version battery", bytes, 3); err != nil {
+		return VersionBatteryResponse{}, err
+	}
+
+	firmwareVersion := bytes[2:]
+	for _, b := range firmwareVersion {
+		if b < 0x20 || b > 0x7e {
+			return VersionBatteryResponse{}, &InvalidFirmwareVersionError{FirmwareVersion: firmwareVersion}
+		}
+	}
+
 	return VersionBatteryResponse{
 		BatteryLevel:    uint8(bytes[0]),
-		FirmwareVersion: string(bytes[2:]),
+		FirmwareVersion: string(firmwareVersion),
+	}, nil
+}
+
+func ParseDeviceName(bytes []byte) (string, error) {
+	// some devices pad the name with zeros
+	name := strings.TrimRight(string(bytes), "\x00")
+	if !utf8.ValidString(name) {
+		return "", errors.Errorf("device name %x is no valid UTF-8", bytes)
 	}
+
+	return name, nil
 }
 
-func ParseSensorData(bytes []byte) SensorDataResponse {
+func ParseAppearance(bytes []byte) (uint16, error) {
+	if err := checkPayloadLength("appearance", bytes, 2); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint16(bytes[0:2]), nil
+}
+
+func ParseSensorData(bytes []byte) (SensorDataResponse, error) {
+	if isPlaceholderData(bytes) {
+		return SensorDataResponse{}, ErrPlaceholderData
+	}
+	if err := checkPayloadLength("sensor data", bytes, 10); err != nil {
+		return SensorDataResponse{}, err
+	}
+
 	return SensorDataResponse{
-		Temperature:  float64(binary.LittleEndian.Uint16(bytes[0:2])) / 10.0,
+		Temperature:  float64(int16(binary.LittleEndian.Uint16(bytes[0:2]))) / 10.0,
 		Brightness:   binary.LittleEndian.Uint32(bytes[3:7]),
 		Moisture:     uint8(bytes[7]),
 		Conductivity: binary.LittleEndian.Uint16(bytes[8:10]),
+	}, nil
+}
+
+func ParseHistoryCount(bytes []byte) (HistoryCountResponse, error) {
+	if err := checkPayloadLength("history count", bytes, 2); err != nil {
+		return HistoryCountResponse{}, err
+	}
+
+	return HistoryCountResponse{
+		EntryCount: binary.LittleEndian.Uint16(bytes[0:2]),
+	}, nil
+}
+
+// Source: https://github.com/open-homeautomation/miflora/blob/master/miflora/miflora_poller.py
+func ParseHistoryEntry(bytes []byte) (HistoryEntryResponse, error) {
+	if isPlaceholderData(bytes) {
+		return HistoryEntryResponse{}, ErrPlaceholderData
 	}
+	if err := checkPayloadLength("history entry", bytes, 14); err != nil {
+		return HistoryEntryResponse{}, err
+	}
+
+	return HistoryEntryResponse{
+		DeviceTime:   binary.LittleEndian.Uint32(bytes[0:4]),
+		Temperature:  float64(int16(binary.LittleEndian.Uint16(bytes[4:6]))) / 10.0,
+		Brightness:   binary.LittleEndian.Uint32(bytes[7:11]),
+		Moisture:     uint8(bytes[11]),
+		Conductivity: binary.LittleEndian.Uint16(bytes[12:14]),
+	}, nil
+}
+
+func ParseDeviceTime(bytes []byte, readAt time.Time) (DeviceTimeResponse, error) {
+	if err := checkPayloadLength("device time", bytes, 4); err != nil {
+		return DeviceTimeResponse{}, err
+	}
+
+	return DeviceTimeResponse{
+		DeviceTime: binary.LittleEndian.Uint32(bytes[0:4]),
+		ReadAt:     readAt,
+	}, nil
 }
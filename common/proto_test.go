@@ -2,6 +2,7 @@ package common
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -19,10 +20,49 @@ func TestParseVersionBattery(t *testing.T) {
 	}
 
 	for _, table := range tables {
-		assert.Equal(t, table.metaData, ParseVersionBattery(table.bytes))
+		metaData, err := ParseVersionBattery(table.bytes)
+		assert.NoError(t, err)
+		assert.Equal(t, table.metaData, metaData)
 	}
 }
 
+func TestParseVersionBatteryInvalid(t *testing.T) {
+	_, err := ParseVersionBattery([]byte{0x64, 0x15})
+	assert.Equal(t, &ShortPayloadError{Payload: "version battery", Expected: 3, Actual: 2}, err)
+
+	_, err = ParseVersionBattery([]byte{0x64, 0x15, 0x32, 0x2e, 0xff, 0x2e, 0x30})
+	assert.Equal(t, &InvalidFirmwareVersionError{FirmwareVersion: []byte{0x32, 0x2e, 0xff, 0x2e, 0x30}}, err)
+
+	_, err = ParseVersionBattery([]byte{0x64, 0x15, 0x32, 0x2e, 0x00, 0x2e, 0x30})
+	assert.IsType(t, &InvalidFirmwareVersionError{}, err)
+}
+
+func TestParseDeviceName(t *testing.T) {
+	name, err := ParseDeviceName([]byte("Flower care"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Flower care", name)
+
+	name, err = ParseDeviceName([]byte{0x46, 0x6c, 0x6f, 0x77, 0x65, 0x72, 0x20, 0x6d, 0x61, 0x74, 0x65, 0x00, 0x00})
+	assert.NoError(t, err)
+	assert.Equal(t, "Flower mate", name)
+
+	_, err = ParseDeviceName([]byte{0x46, 0xff, 0xfe})
+	assert.Error(t, err)
+}
+
+func TestParseAppearance(t *testing.T) {
+	appearance, err := ParseAppearance([]byte{0x00, 0x00})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0), appearance)
+
+	appearance, err = ParseAppearance([]byte{0x40, 0x05})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x0540), appearance)
+
+	_, err = ParseAppearance([]byte{0x40})
+	assert.Equal(t, &ShortPayloadError{Payload: "appearance", Expected: 2, Actual: 1}, err)
+}
+
 func TestParseSensorData(t *testing.T) {
 	tables := []struct {
 		bytes      []byte
@@ -37,9 +77,93 @@ func TestParseSensorData(t *testing.T) {
 			[]byte{0x25, 0x01, 0x00, 0xf7, 0x26, 0x00, 0x00, 0x28, 0x0e, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
 			SensorDataResponse{Temperature: 29.3, Brightness: 9975, Moisture: 40, Conductivity: 270},
 		},
+		// below freezing
+		{
+			[]byte{0xce, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x28, 0x0e, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			SensorDataResponse{Temperature: -5.0, Brightness: 0, Moisture: 40, Conductivity: 270},
+		},
 	}
 
 	for _, table := range tables {
-		assert.Equal(t, table.sensorData, ParseSensorData(table.bytes))
+		sensorData, err := ParseSensorData(table.bytes)
+		assert.NoError(t, err)
+		assert.Equal(t, table.sensorData, sensorData)
 	}
 }
+
+func TestParseSensorDataInvalid(t *testing.T) {
+	_, err := ParseSensorData([]byte{0xf2, 0x00, 0x00, 0x79, 0x00, 0x00, 0x00, 0x10, 0x65})
+	assert.Equal(t, &ShortPayloadError{Payload: "sensor data", Expected: 10, Actual: 9}, err)
+
+	_, err = ParseSensorData([]byte{})
+	assert.IsType(t, &ShortPayloadError{}, err)
+
+	_, err = ParseSensorData(MifloraPlaceholderData)
+	assert.Equal(t, ErrPlaceholderData, err)
+
+	_, err = ParseSensorData([]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x99, 0x88, 0x77, 0x66})
+	assert.Equal(t, ErrPlaceholderData, err)
+}
+
+func TestMifloraGetHistoryEntryAddressData(t *testing.T) {
+	assert.Equal(t, []byte{0xa1, 0x00, 0x00}, MifloraGetHistoryEntryAddressData(0))
+	assert.Equal(t, []byte{0xa1, 0x2a, 0x00}, MifloraGetHistoryEntryAddressData(42))
+	assert.Equal(t, []byte{0xa1, 0x01, 0x02}, MifloraGetHistoryEntryAddressData(513))
+}
+
+func TestParseHistoryCount(t *testing.T) {
+	tables := []struct {
+		bytes        []byte
+		historyCount HistoryCountResponse
+	}{
+		{[]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, HistoryCountResponse{EntryCount: 0}},
+		{[]byte{0x55, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, HistoryCountResponse{EntryCount: 341}},
+	}
+
+	for _, table := range tables {
+		historyCount, err := ParseHistoryCount(table.bytes)
+		assert.NoError(t, err)
+		assert.Equal(t, table.historyCount, historyCount)
+	}
+
+	_, err := ParseHistoryCount([]byte{0x55})
+	assert.IsType(t, &ShortPayloadError{}, err)
+}
+
+func TestParseHistoryEntry(t *testing.T) {
+	tables := []struct {
+		bytes        []byte
+		historyEntry HistoryEntryResponse
+	}{
+		{
+			[]byte{0x10, 0x0e, 0x00, 0x00, 0xf2, 0x00, 0x00, 0x79, 0x00, 0x00, 0x00, 0x10, 0x65, 0x00, 0x00, 0x00},
+			HistoryEntryResponse{DeviceTime: 3600, Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		},
+		{
+			[]byte{0x20, 0x1c, 0x00, 0x00, 0xce, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x28, 0x0e, 0x01, 0x00, 0x00},
+			HistoryEntryResponse{DeviceTime: 7200, Temperature: -5.0, Brightness: 0, Moisture: 40, Conductivity: 270},
+		},
+	}
+
+	for _, table := range tables {
+		historyEntry, err := ParseHistoryEntry(table.bytes)
+		assert.NoError(t, err)
+		assert.Equal(t, table.historyEntry, historyEntry)
+	}
+
+	_, err := ParseHistoryEntry([]byte{0x10, 0x0e, 0x00, 0x00, 0xf2, 0x00, 0x00, 0x79, 0x00, 0x00, 0x00, 0x10, 0x65})
+	assert.IsType(t, &ShortPayloadError{}, err)
+
+	_, err = ParseHistoryEntry(MifloraPlaceholderData)
+	assert.Equal(t, ErrPlaceholderData, err)
+}
+
+func TestParseDeviceTime(t *testing.T) {
+	readAt := time.Unix(1500000000, 0)
+	deviceTime, err := ParseDeviceTime([]byte{0x80, 0x51, 0x01, 0x00}, readAt)
+	assert.NoError(t, err)
+	assert.Equal(t, DeviceTimeResponse{DeviceTime: 86400, ReadAt: readAt}, deviceTime)
+
+	_, err = ParseDeviceTime([]byte{0x80, 0x51, 0x01}, readAt)
+	assert.IsType(t, &ShortPayloadError{}, err)
+}
@@ -0,0 +1,348 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"miflorad/common"
+
+	"github.com/pkg/errors"
+)
+
+// simulates a miflora device, all fields may be changed between connections
+type Peripheral struct {
+	ID              string // as "C4:7C:8D:xx:xx:xx"
+	Name            string // device name, defaults to "Flower care"
+	Appearance      uint16
+	FirmwareVersion string // as "x.y.z"
+	BatteryLevel    uint8  // in percent 0-100
+	SensorData      common.SensorDataResponse
+	RSSI            int
+	// device clock in seconds since device boot and stored history entries
+	DeviceTime uint32
+	History    []common.HistoryEntryResponse
+
+	ConnectLatency time.Duration // time until a connection is established
+	Latency        time.Duration // time per characteristic read or write
+	NotifyInterval time.Duration // time between sensor data notifications, defaults to 1s
+	// number of upcoming connection attempts that fail
+	FailConnects int
+	// connection will be dropped by the device after that many reads/writes/notifications, 0 means never
+	DisconnectAfter int
+	// answer every sensor data read with the placeholder even after a mode change
+	AlwaysPlaceholder bool
+
+	// counts connections established to this device, blink commands received and history entries read
+	Connects     int
+	Blinks       int
+	HistoryReads int
+}
+
+func (p *Peripheral) versionBatteryBytes() []byte {
+	return append([]byte{p.BatteryLevel, 0x15}, []byte(p.FirmwareVersion)...)
+}
+
+func (p *Peripheral) sensorDataBytes() []byte {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint16(data[0:2], uint16(int16(math.Round(p.SensorData.Temperature*10))))
+	binary.LittleEndian.PutUint32(data[3:7], p.SensorData.Brightness)
+	data[7] = p.SensorData.Moisture
+	binary.LittleEndian.PutUint16(data[8:10], p.SensorData.Conductivity)
+	return data
+}
+
+func historyEntryBytes(entry common.HistoryEntryResponse) []byte {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint32(data[0:4], entry.DeviceTime)
+	binary.LittleEndian.PutUint16(data[4:6], uint16(int16(math.Round(entry.Temperature*10))))
+	binary.LittleEndian.PutUint32(data[7:11], entry.Brightness)
+	data[11] = entry.Moisture
+	binary.LittleEndian.PutUint16(data[12:14], entry.Conductivity)
+	return data
+}
+
+var _ common.MifloraBackend = (*Backend)(nil)
+
+// implements common.MifloraBackend for simulated devices kept in memory
+type Backend struct {
+	// guards all simulated peripherals and connections
+	lock        sync.Mutex
+	peripherals []*Peripheral
+	stopped     bool
+}
+
+func NewBackend(peripherals ...*Peripheral) *Backend {
+	return &Backend{peripherals: peripherals}
+}
+
+// safely changes a simulated peripheral while connections might be in progress
+func (b *Backend) Update(f func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	f()
+}
+
+func (b *Backend) find(peripheralID string) *Peripheral {
+	for _, p := range b.peripherals {
+		if strings.EqualFold(p.ID, peripheralID) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (b *Backend) Connect(ctx context.Context, peripheralID string) (common.MifloraConn, error) {
+	b.lock.Lock()
+	p := b.find(peripheralID)
+	stopped := b.stopped
+	b.lock.Unlock()
+
+	if stopped {
+		return nil, errors.New("Backend already stopped")
+	}
+
+	if p == nil {
+		// a real scan would only end on timeout
+		<-ctx.Done()
+		return nil, errors.Wrapf(ctx.Err(), "can't discover %s", peripheralID)
+	}
+
+	b.lock.Lock()
+	connectLatency := p.ConnectLatency
+	b.lock.Unlock()
+
+	select {
+	case <-time.After(connectLatency):
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "can't connect to %s", peripheralID)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if p.FailConnects > 0 {
+		p.FailConnects--
+		return nil, errors.Errorf("can't connect to %s: connection failed", peripheralID)
+	}
+	p.Connects++
+
+	return &conn{backend: b, p: p, rssi: p.RSSI, done: make(chan struct{})}, nil
+}
+
+func (b *Backend) Stop() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.stopped = true
+	return nil
+}
+
+var _ common.MifloraConn = (*conn)(nil)
+
+// implements common.MifloraConn for a simulated peripheral
+type conn struct {
+	backend *Backend
+	p       *Peripheral
+	rssi    int
+
+	closed         bool
+	done           chan struct{}
+	operations     int
+	modeChanged    bool
+	historyAddress []byte
+	// closed to stop sending notifications, notifying is closed once stopped
+	stopNotify chan struct{}
+	notifying  chan struct{}
+}
+
+// must be called with backend lock held
+func (c *conn) markClosed() {
+	c.closed = true
+	close(c.done)
+}
+
+// simulates latency and dropped connections, returns with backend lock held on success
+func (c *conn) operation() error {
+	c.backend.lock.Lock()
+	latency := c.p.Latency
+	c.backend.lock.Unlock()
+
+	time.Sleep(latency)
+
+	c.backend.lock.Lock()
+	if c.closed {
+		c.backend.lock.Unlock()
+		return errors.New("Connection closed")
+	}
+	c.operations++
+	if c.p.DisconnectAfter > 0 && c.operations > c.p.DisconnectAfter {
+		c.markClosed()
+		c.backend.lock.Unlock()
+		return errors.New("Connection dropped by device")
+	}
+	return nil
+}
+
+// must be called with backend lock held
+func (c *conn) sensorDataBytes() []byte {
+	metaData := common.VersionBatteryResponse{FirmwareVersion: c.p.FirmwareVersion}
+	if c.p.AlwaysPlaceholder || (metaData.RequiresModeChangeBeforeRead() && !c.modeChanged) {
+		return append([]byte{}, common.MifloraPlaceholderData...)
+	}
+	return c.p.sensorDataBytes()
+}
+
+func (c *conn) ReadCharacteristic(uuid string) ([]byte, error) {
+	if err := c.operation(); err != nil {
+		return nil, err
+	}
+	defer c.backend.lock.Unlock()
+
+	switch uuid {
+	case common.CharDeviceNameUUID:
+		if c.p.Name == "" {
+			return []byte("Flower care"), nil
+		}
+		return []byte(c.p.Name), nil
+	case common.CharAppearanceUUID:
+		data := make([]byte, 2)
+		binary.LittleEndian.PutUint16(data, c.p.Appearance)
+		return data, nil
+	case common.MifloraCharVersionBatteryUUID:
+		return c.p.versionBatteryBytes(), nil
+	case common.MifloraCharReadSensorDataUUID:
+		return c.sensorDataBytes(), nil
+	case common.MifloraCharHistoryDeviceTimeUUID:
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, c.p.DeviceTime)
+		return data, nil
+	case common.MifloraCharHistoryReadUUID:
+		data := make([]byte, 16)
+		switch {
+		case bytes.Equal(c.historyAddress, common.MifloraGetHistoryInitData()):
+			binary.LittleEndian.PutUint16(data[0:2], uint16(len(c.p.History)))
+		case len(c.historyAddress) == 3 && c.historyAddress[0] == 0xa1:
+			index := int(binary.LittleEndian.Uint16(c.historyAddress[1:3]))
+			if index >= len(c.p.History) {
+				return nil, errors.Errorf("History entry %d does not exist", index)
+			}
+			data = historyEntryBytes(c.p.History[index])
+			c.p.HistoryReads++
+		}
+		return data, nil
+	case common.MifloraCharModeChangeUUID, common.MifloraCharHistoryControlUUID:
+		return []byte{0x00, 0x00}, nil
+	}
+
+	return nil, &common.ProfileDiscoveryError{Err: errors.Errorf("Failed to discover the characteristic %s", uuid)}
+}
+
+func (c *conn) WriteCharacteristic(uuid string, data []byte) error {
+	if err := c.operation(); err != nil {
+		return err
+	}
+	defer c.backend.lock.Unlock()
+
+	switch uuid {
+	case common.MifloraCharModeChangeUUID:
+		switch {
+		case bytes.Equal(data, common.MifloraGetModeChangeData()):
+			c.modeChanged = true
+		case bytes.Equal(data, common.MifloraGetBlinkData()):
+			c.p.Blinks++
+		}
+		return nil
+	case common.MifloraCharHistoryControlUUID:
+		c.historyAddress = append([]byte{}, data...)
+		return nil
+	}
+
+	return &common.ProfileDiscoveryError{Err: errors.Errorf("Failed to discover the characteristic %s", uuid)}
+}
+
+func (c *conn) SubscribeCharacteristic(uuid string, handler func(data []byte)) error {
+	if err := c.operation(); err != nil {
+		return err
+	}
+	defer c.backend.lock.Unlock()
+
+	if uuid != common.MifloraCharReadSensorDataUUID {
+		return errors.Errorf("Characteristic %s does not support notifications", uuid)
+	}
+	if c.stopNotify != nil {
+		return errors.New("Characteristic already subscribed")
+	}
+
+	notifyInterval := c.p.NotifyInterval
+	if notifyInterval == 0 {
+		notifyInterval = 1 * time.Second
+	}
+
+	c.stopNotify = make(chan struct{})
+	c.notifying = make(chan struct{})
+	go c.notify(notifyInterval, handler)
+
+	return nil
+}
+
+func (c *conn) notify(notifyInterval time.Duration, handler func(data []byte)) {
+	defer close(c.notifying)
+
+	ticker := time.NewTicker(notifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stopNotify:
+			return
+		}
+
+		c.backend.lock.Lock()
+		if c.closed {
+			c.backend.lock.Unlock()
+			return
+		}
+		c.operations++
+		if c.p.DisconnectAfter > 0 && c.operations > c.p.DisconnectAfter {
+			// connection dropped by device
+			c.markClosed()
+			c.backend.lock.Unlock()
+			return
+		}
+		data := c.sensorDataBytes()
+		c.backend.lock.Unlock()
+
+		handler(data)
+	}
+}
+
+func (c *conn) RSSI() int {
+	return c.rssi
+}
+
+func (c *conn) Disconnected() <-chan struct{} {
+	return c.done
+}
+
+func (c *conn) Close() error {
+	c.backend.lock.Lock()
+	if c.closed {
+		c.backend.lock.Unlock()
+		return errors.New("Connection already closed")
+	}
+	c.markClosed()
+	stopNotify, notifying := c.stopNotify, c.notifying
+	c.backend.lock.Unlock()
+
+	// no notifications will be delivered after closing
+	if stopNotify != nil {
+		close(stopNotify)
+		<-notifying
+	}
+	return nil
+}
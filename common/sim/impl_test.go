@@ -0,0 +1,184 @@
+package sim
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"miflorad/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPeripheral() *Peripheral {
+	return &Peripheral{
+		ID:              "C4:7C:8D:66:D5:27",
+		FirmwareVersion: "2.7.0",
+		BatteryLevel:    99,
+		SensorData:      common.SensorDataResponse{Temperature: 24.2, Brightness: 121, Moisture: 16, Conductivity: 101},
+		RSSI:            -64,
+		DeviceTime:      7200,
+		History: []common.HistoryEntryResponse{
+			{DeviceTime: 3600, Temperature: -5.0, Brightness: 0, Moisture: 40, Conductivity: 270},
+		},
+	}
+}
+
+func TestReadMiflora(t *testing.T) {
+	p := newTestPeripheral()
+	backend := NewBackend(p)
+
+	conn, err := backend.Connect(context.Background(), "c4:7c:8d:66:d5:27")
+	assert.NoError(t, err)
+	assert.Equal(t, -64, conn.RSSI())
+
+	metaData, sensorData, err := common.ReadMiflora(conn, common.VersionBatteryResponse{}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, common.VersionBatteryResponse{BatteryLevel: 99, FirmwareVersion: "2.7.0"}, metaData)
+	assert.Equal(t, p.SensorData, sensorData)
+
+	deviceTime, err := common.RequestDeviceTime(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7200), deviceTime.DeviceTime)
+
+	history, err := common.RequestHistory(conn, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, p.History, history)
+
+	assert.NoError(t, conn.Close())
+	assert.Error(t, conn.Close())
+	assert.Equal(t, 1, p.Connects)
+}
+
+func TestRequestHistorySince(t *testing.T) {
+	p := newTestPeripheral()
+	p.History = nil
+	for i := 1; i <= 1000; i++ {
+		p.History = append(p.History, common.HistoryEntryResponse{DeviceTime: uint32(i * 3600), Moisture: uint8(i % 100)})
+	}
+	backend := NewBackend(p)
+
+	conn, err := backend.Connect(context.Background(), p.ID)
+	assert.NoError(t, err)
+
+	// only the entries after since and the one before are read
+	history, err := common.RequestHistory(conn, 997*3600)
+	assert.NoError(t, err)
+	assert.Equal(t, p.History[997:], history)
+	assert.Equal(t, 4, p.HistoryReads)
+
+	history, err = common.RequestHistory(conn, 1000*3600)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+	assert.Equal(t, 5, p.HistoryReads)
+}
+
+func TestPlaceholderWithoutModeChange(t *testing.T) {
+	backend := NewBackend(newTestPeripheral())
+
+	conn, err := backend.Connect(context.Background(), "C4:7C:8D:66:D5:27")
+	assert.NoError(t, err)
+
+	bytes, err := conn.ReadCharacteristic(common.MifloraCharReadSensorDataUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, common.MifloraPlaceholderData, bytes)
+
+	assert.NoError(t, common.RequestModeChange(conn))
+	bytes, err = conn.ReadCharacteristic(common.MifloraCharReadSensorDataUUID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, common.MifloraPlaceholderData, bytes)
+}
+
+func TestConnectFailures(t *testing.T) {
+	p := newTestPeripheral()
+	p.FailConnects = 1
+	p.DisconnectAfter = 1
+	backend := NewBackend(p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := backend.Connect(ctx, "C4:7C:8D:00:00:00")
+	assert.Error(t, err)
+
+	_, err = backend.Connect(context.Background(), p.ID)
+	assert.Error(t, err)
+
+	conn, err := backend.Connect(context.Background(), p.ID)
+	assert.NoError(t, err)
+	_, err = common.RequestVersionBattery(conn)
+	assert.NoError(t, err)
+	_, err = common.RequestSensorData(conn)
+	assert.Error(t, err)
+
+	backend.Update(func() { p.ConnectLatency = time.Second })
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel2()
+	_, err = backend.Connect(ctx2, p.ID)
+	assert.Error(t, err)
+}
+
+func TestBlink(t *testing.T) {
+	p := newTestPeripheral()
+	backend := NewBackend(p)
+
+	conn, err := backend.Connect(context.Background(), "C4:7C:8D:66:D5:27")
+	assert.NoError(t, err)
+
+	assert.NoError(t, common.RequestBlink(conn))
+	assert.Equal(t, 1, p.Blinks)
+	assert.NoError(t, conn.Close())
+}
+
+func TestSubscribeSensorData(t *testing.T) {
+	p := newTestPeripheral()
+	p.NotifyInterval = 5 * time.Millisecond
+	backend := NewBackend(p)
+
+	conn, err := backend.Connect(context.Background(), "C4:7C:8D:66:D5:27")
+	assert.NoError(t, err)
+
+	received := make(chan common.SensorDataResponse, 100)
+	err = common.SubscribeSensorData(conn, common.VersionBatteryResponse{FirmwareVersion: p.FirmwareVersion}, func(sensorData common.SensorDataResponse, err error) {
+		assert.NoError(t, err)
+		received <- sensorData
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, p.SensorData, <-received)
+	assert.Equal(t, p.SensorData, <-received)
+
+	assert.NoError(t, conn.Close())
+	// no notifications after closing
+	count := len(received)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, count, len(received))
+}
+
+func TestDisconnected(t *testing.T) {
+	p := newTestPeripheral()
+	p.NotifyInterval = 5 * time.Millisecond
+	p.DisconnectAfter = 3
+	backend := NewBackend(p)
+
+	conn, err := backend.Connect(context.Background(), "C4:7C:8D:66:D5:27")
+	assert.NoError(t, err)
+
+	received := make(chan common.SensorDataResponse, 100)
+	err = common.SubscribeSensorData(conn, common.VersionBatteryResponse{FirmwareVersion: p.FirmwareVersion}, func(sensorData common.SensorDataResponse, err error) {
+		received <- sensorData
+	})
+	assert.NoError(t, err)
+
+	select {
+	case <-conn.Disconnected():
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "connection not dropped")
+	}
+	assert.Error(t, conn.Close())
+
+	conn, err = backend.Connect(context.Background(), "C4:7C:8D:66:D5:27")
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+	_, open := <-conn.Disconnected()
+	assert.False(t, open)
+}